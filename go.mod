@@ -1,10 +1,18 @@
 module github.com/prometheus/influxdb_exporter
 
+go 1.13
+
 require (
+	github.com/alecthomas/units v0.0.0-20190717042225-c3de453c63f4
+	github.com/coreos/go-systemd/v22 v22.0.0
+	github.com/golang/protobuf v1.3.2
 	github.com/influxdata/influxdb v1.3.1
-	github.com/prometheus/client_golang v1.0.0
-	github.com/prometheus/common v0.4.1
-	golang.org/x/crypto v0.0.0-20190103213133-ff983b9c42bc // indirect
-	golang.org/x/sys v0.0.0-20190102155601-82a175fd1598 // indirect
+	github.com/prometheus/client_golang v1.5.1
+	github.com/prometheus/client_model v0.2.0
+	github.com/prometheus/common v0.9.1
+	github.com/segmentio/kafka-go v0.3.10
+	github.com/sirupsen/logrus v1.4.2
+	golang.org/x/time v0.0.0-20191024005414-555d28b269f0
 	gopkg.in/alecthomas/kingpin.v2 v2.2.6
+	gopkg.in/yaml.v2 v2.2.5
 )
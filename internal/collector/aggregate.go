@@ -0,0 +1,205 @@
+// Copyright 2016 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+)
+
+// group is a set of samples forming a histogram or a summary: the buckets or
+// quantiles along with the _sum and _count samples.
+type group struct {
+	name   string
+	labels map[string]string
+	// points maps the upper bounds or the quantiles to their samples.
+	points map[float64]*Sample
+	sum    *Sample
+	count  *Sample
+}
+
+// timestamp returns the most recent timestamp of the samples of the group.
+func (g *group) timestamp() time.Time {
+	ts := g.sum.Timestamp
+	if g.count.Timestamp.After(ts) {
+		ts = g.count.Timestamp
+	}
+	for _, s := range g.points {
+		if s.Timestamp.After(ts) {
+			ts = s.Timestamp
+		}
+	}
+	return ts
+}
+
+// seriesKey identifies the series of the name and labels, ignoring the skip
+// label.
+func seriesKey(name string, labels map[string]string, skip string) string {
+	names := make([]string, 0, len(labels))
+	for k := range labels {
+		if k != skip {
+			names = append(names, k)
+		}
+	}
+	sort.Strings(names)
+	parts := make([]string, 0, len(names)*2+1)
+	parts = append(parts, name)
+	for _, k := range names {
+		parts = append(parts, k, labels[k])
+	}
+	return fmt.Sprintf("%q", parts)
+}
+
+// groupSamples finds the complete groups of samples named <name><suffix> with
+// a numeric label and <name>_sum and <name>_count samples of the same series.
+// It returns the groups and the samples that are not part of any. Samples
+// named like the series of a complete group but not part of one would make
+// the exposition invalid and are dropped.
+func groupSamples(samples []*Sample, suffix, label string) ([]*group, []*Sample) {
+	series := make(map[string]*Sample, len(samples))
+	for _, s := range samples {
+		if _, ok := s.Labels[label]; !ok {
+			series[seriesKey(s.Name, s.Labels, "")] = s
+		}
+	}
+
+	var (
+		groups []*group
+		byKey  = map[string]*group{}
+	)
+	for _, s := range samples {
+		v, ok := s.Labels[label]
+		if !ok || !strings.HasSuffix(s.Name, suffix) {
+			continue
+		}
+		bound, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			continue
+		}
+		name := strings.TrimSuffix(s.Name, suffix)
+		key := seriesKey(name, s.Labels, label)
+		g, ok := byKey[key]
+		if !ok {
+			g = &group{
+				name:   name,
+				labels: make(map[string]string, len(s.Labels)-1),
+				points: map[float64]*Sample{},
+				sum:    series[seriesKey(name+"_sum", s.Labels, label)],
+				count:  series[seriesKey(name+"_count", s.Labels, label)],
+			}
+			for k, v := range s.Labels {
+				if k != label {
+					g.labels[k] = v
+				}
+			}
+			byKey[key] = g
+			groups = append(groups, g)
+		}
+		g.points[bound] = s
+	}
+
+	var (
+		grouped  = map[*Sample]struct{}{}
+		reserved = map[string]struct{}{}
+		complete = groups[:0]
+	)
+	for _, g := range groups {
+		if g.sum == nil || g.count == nil {
+			continue
+		}
+		complete = append(complete, g)
+		grouped[g.sum] = struct{}{}
+		grouped[g.count] = struct{}{}
+		for _, s := range g.points {
+			grouped[s] = struct{}{}
+		}
+		for _, n := range []string{g.name, g.name + suffix, g.name + "_sum", g.name + "_count"} {
+			reserved[n] = struct{}{}
+		}
+	}
+	if len(complete) == 0 {
+		return nil, samples
+	}
+	rest := make([]*Sample, 0, len(samples)-len(grouped))
+	for _, s := range samples {
+		if _, ok := grouped[s]; ok {
+			continue
+		}
+		if _, ok := reserved[s.Name]; ok {
+			log.Debugf("Dropping sample %s colliding with a grouped series", s.ID)
+			continue
+		}
+		rest = append(rest, s)
+	}
+	return complete, rest
+}
+
+// histograms converts the <name>_bucket samples with a le label along with
+// their <name>_sum and <name>_count samples to histograms. It returns the
+// histograms and the remaining samples.
+func (c *Collector) histograms(samples []*Sample) ([]prometheus.Metric, []*Sample) {
+	groups, rest := groupSamples(samples, "_bucket", "le")
+	metrics := make([]prometheus.Metric, 0, len(groups))
+	for _, g := range groups {
+		buckets := make(map[float64]uint64, len(g.points))
+		for bound, s := range g.points {
+			if !math.IsInf(bound, 1) {
+				buckets[bound] = uint64(s.Value)
+			}
+		}
+		m := prometheus.MustNewConstHistogram(
+			prometheus.NewDesc(g.name, "InfluxDB Metric", []string{}, g.labels),
+			uint64(g.count.Value),
+			g.sum.Value,
+			buckets,
+		)
+		if c.cfg.ExportTimestamp {
+			m = prometheus.NewMetricWithTimestamp(g.timestamp(), m)
+		}
+		metrics = append(metrics, m)
+	}
+	return metrics, rest
+}
+
+// summaries converts the <name> samples with a quantile label along with
+// their <name>_sum and <name>_count samples to summaries. It returns the
+// summaries and the remaining samples.
+func (c *Collector) summaries(samples []*Sample) ([]prometheus.Metric, []*Sample) {
+	groups, rest := groupSamples(samples, "", "quantile")
+	metrics := make([]prometheus.Metric, 0, len(groups))
+	for _, g := range groups {
+		quantiles := make(map[float64]float64, len(g.points))
+		for q, s := range g.points {
+			quantiles[q] = s.Value
+		}
+		m := prometheus.MustNewConstSummary(
+			prometheus.NewDesc(g.name, "InfluxDB Metric", []string{}, g.labels),
+			uint64(g.count.Value),
+			g.sum.Value,
+			quantiles,
+		)
+		if c.cfg.ExportTimestamp {
+			m = prometheus.NewMetricWithTimestamp(g.timestamp(), m)
+		}
+		metrics = append(metrics, m)
+	}
+	return metrics, rest
+}
@@ -0,0 +1,62 @@
+// Copyright 2016 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"testing"
+)
+
+func TestHistograms(t *testing.T) {
+	c := newTestCollector(Config{DetectHistograms: true})
+	parse(t, c, `latency,host=a,le=0.1 request_bucket=1i
+latency,host=a,le=0.5 request_bucket=3i
+latency,host=a,le=+Inf request_bucket=4i
+latency,host=a request_sum=2.5,request_count=4i
+latency,host=b,le=0.1 request_bucket=2i
+latency,host=a errors=1i`)
+
+	// The buckets of host b lack the _sum and _count samples and collide
+	// with the histogram.
+	compare(t, c, `
+# HELP latency_errors InfluxDB Metric
+# TYPE latency_errors untyped
+latency_errors{host="a"} 1
+# HELP latency_request InfluxDB Metric
+# TYPE latency_request histogram
+latency_request_bucket{host="a",le="0.1"} 1
+latency_request_bucket{host="a",le="0.5"} 3
+latency_request_bucket{host="a",le="+Inf"} 4
+latency_request_sum{host="a"} 2.5
+latency_request_count{host="a"} 4
+`, "latency_errors", "latency_request", "latency_request_bucket", "latency_request_sum", "latency_request_count")
+}
+
+func TestSummaries(t *testing.T) {
+	c := newTestCollector(Config{DetectSummaries: true})
+	parse(t, c, `rpc,host=a,quantile=0.5 duration=0.02
+rpc,host=a,quantile=0.99 duration=0.3
+rpc,host=a duration_sum=12.5,duration_count=100i
+rpc,host=b,quantile=0.5 duration=0.01`)
+
+	// The quantile of host b lacks the _sum and _count samples and collides
+	// with the summary.
+	compare(t, c, `
+# HELP rpc_duration InfluxDB Metric
+# TYPE rpc_duration summary
+rpc_duration{host="a",quantile="0.5"} 0.02
+rpc_duration{host="a",quantile="0.99"} 0.3
+rpc_duration_sum{host="a"} 12.5
+rpc_duration_count{host="a"} 100
+`, "rpc_duration", "rpc_duration_sum", "rpc_duration_count")
+}
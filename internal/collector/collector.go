@@ -0,0 +1,1072 @@
+// Copyright 2016 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package collector converts InfluxDB points to Prometheus samples and
+// exposes them as a prometheus.Collector.
+package collector
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/golang/protobuf/ptypes"
+	"github.com/influxdata/influxdb/models"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/log"
+)
+
+var invalidChars = regexp.MustCompile("[^a-zA-Z0-9_]")
+
+// maxExactInt is the magnitude from which integers may lose precision when
+// converted to float64.
+const maxExactInt = 1 << 53
+
+// Config holds the settings of a Collector.
+type Config struct {
+	// SampleExpiry is how long a sample is valid for. Zero means that
+	// samples without their own expiry are collected once then dropped.
+	SampleExpiry time.Duration
+	// ExportTimestamp exports samples with the timestamp of their point.
+	ExportTimestamp bool
+	// KeepTags restricts the tags exported as labels. All tags are kept
+	// when empty.
+	KeepTags []string
+	// TagKeyTrimPrefix and TagKeyTrimSuffix are trimmed from the tag keys
+	// not renamed by the mapping. A key made only of the prefix and suffix
+	// is kept as is.
+	TagKeyTrimPrefix string
+	TagKeyTrimSuffix string
+	// InstanceLabelName and InstanceLabelValue define a label identifying
+	// the exporter, set on every sample and overriding tags and extra
+	// labels with the same name. Disabled when the name is empty.
+	InstanceLabelName  string
+	InstanceLabelValue string
+	// KeepFields restricts the fields converted to samples for the
+	// measurements having at least one of them. Other measurements keep all
+	// their fields.
+	KeepFields []FieldKey
+	// ExpiryTag is the tag whose value, a duration, overrides SampleExpiry
+	// for the point. Disabled when empty.
+	ExpiryTag string
+	// LowercaseNames converts metric and label names to lower case.
+	LowercaseNames bool
+	// TagsPrecedence keeps the value of point tags over extra labels with
+	// the same name.
+	TagsPrecedence bool
+	// NameSeparator joins the measurement and field names, "_" if empty.
+	// The metric name is sanitized afterwards so any character other than
+	// letters, digits and "_" is replaced by "_".
+	NameSeparator string
+	// SingleFieldBareName names the metrics of the points with a single
+	// numeric field after the measurement only.
+	SingleFieldBareName bool
+	// FieldLabel, when not empty, names the metrics after the measurement
+	// only and exports the field, unless it is "value", as a label with
+	// this name.
+	FieldLabel string
+	// IntAsCounter exports integer fields as counters.
+	IntAsCounter bool
+	// DropImprecise drops the integer fields that can't be converted to a
+	// float without losing precision.
+	DropImprecise bool
+	// CoerceNumericStrings parses string fields holding a finite number
+	// instead of dropping them.
+	CoerceNumericStrings bool
+	// TypeOverrides sets the metric type of specific fields, taking
+	// precedence over IntAsCounter and Mapping.
+	TypeOverrides map[FieldKey]prometheus.ValueType
+	// ExemplarTag is the tag whose value is attached as an exemplar to
+	// counter samples named <name>_total instead of being exported as a
+	// label. Exemplars are only exposed in the OpenMetrics format. Disabled
+	// when empty.
+	ExemplarTag string
+	// Mapping rewrites the metrics of matching points. Optional.
+	Mapping *MappingConfig
+	// DetectHistograms exports the <name>_bucket samples with a le label
+	// along with the <name>_sum and <name>_count samples of the same series
+	// as histograms.
+	DetectHistograms bool
+	// DetectSummaries exports the samples with a quantile label along with
+	// the <name>_sum and <name>_count samples of the same series as
+	// summaries.
+	DetectSummaries bool
+	// MaxLabels is the maximum number of labels of a sample, not counting
+	// the instance label. Unlimited if zero.
+	MaxLabels int
+	// MaxLabelsMode is the policy applied to samples with more labels than
+	// MaxLabels, MaxLabelsDrop if empty.
+	MaxLabelsMode string
+	// DedupMode is the policy applied when a sample of an already stored
+	// series is received, DedupLastWrite if empty. Stale samples are always
+	// replaced.
+	DedupMode string
+	// SkipIdentical keeps the stored sample when a sample of the same series
+	// with the same value is received, so its timestamp doesn't advance.
+	// Stale samples are always replaced.
+	SkipIdentical bool
+	// MinRetention keeps expired samples until they have been collected once
+	// after their expiry.
+	MinRetention bool
+	// MaxCollectSeries is the maximum number of series exported per
+	// collection, in the order of the sample IDs. Unlimited if zero.
+	MaxCollectSeries int
+	// ChannelBuffer is the number of samples that can be queued before
+	// ParsePoints blocks.
+	ChannelBuffer int
+	// PersistPath is the file where the samples are saved every minute and
+	// loaded from by NewCollector. Disabled when empty.
+	PersistPath string
+	// DropOnFull drops the samples instead of blocking when the channel
+	// buffer is full.
+	DropOnFull bool
+}
+
+// Policies for samples of a series already stored.
+const (
+	// DedupLastWrite replaces the stored sample.
+	DedupLastWrite = "last-write"
+	// DedupLatestTimestamp replaces the stored sample if the new one is
+	// more recent.
+	DedupLatestTimestamp = "latest-timestamp"
+	// DedupMax keeps the highest value.
+	DedupMax = "max"
+	// DedupSum adds the new value to the stored one.
+	DedupSum = "sum"
+)
+
+// Policies for samples with more labels than MaxLabels.
+const (
+	// MaxLabelsDrop drops the sample.
+	MaxLabelsDrop = "drop"
+	// MaxLabelsTruncate keeps the first tags in alphabetical order along with
+	// the field label and the extra labels. The sample is dropped if there
+	// are still too many labels.
+	MaxLabelsTruncate = "truncate"
+)
+
+// FieldKey identifies a field of a measurement.
+type FieldKey struct {
+	Measurement string
+	Field       string
+}
+
+// Sample is a single value converted from an InfluxDB point field.
+type Sample struct {
+	ID string
+	// Measurement and Field are the point measurement and field the
+	// sample was converted from.
+	Measurement string
+	Field       string
+	Name        string
+	Labels      map[string]string
+	Value       float64
+	Type        prometheus.ValueType
+	Timestamp   time.Time
+	// Expiry overrides the global sample expiry when not zero.
+	Expiry time.Duration
+	// Exemplar is the value of the exemplar tag, if any.
+	Exemplar string
+
+	// served is true once the sample has been collected and servedExpired
+	// once it has been collected after its expiry. Protected by the
+	// collector's mutex.
+	served        bool
+	servedExpired bool
+}
+
+// expired reports whether the sample is too old to be exported at now.
+func (s *Sample) expired(now time.Time, defaultExpiry time.Duration) bool {
+	expiry := defaultExpiry
+	if s.Expiry > 0 {
+		expiry = s.Expiry
+	}
+	return now.Sub(s.Timestamp) > expiry
+}
+
+// serveOnce reports whether the sample is dropped once collected.
+func (c *Collector) serveOnce(s *Sample) bool {
+	return c.cfg.SampleExpiry == 0 && s.Expiry == 0
+}
+
+// stale reports whether the sample must not be exported anymore.
+func (c *Collector) stale(s *Sample, now time.Time) bool {
+	if c.serveOnce(s) {
+		return s.served
+	}
+	return s.expired(now, c.cfg.SampleExpiry) && (!c.cfg.MinRetention || s.servedExpired)
+}
+
+// Collector stores the samples converted from InfluxDB points.
+type Collector struct {
+	cfg      Config
+	samples  map[string]*Sample
+	mu       sync.Mutex
+	ch       chan *Sample
+	keepTags map[string]struct{}
+	// keepFields maps measurements to the fields to keep.
+	keepFields map[string]map[string]struct{}
+
+	namesMu sync.Mutex
+	// lowercased maps lower-cased metric names to the first original name
+	// seen, to detect collisions. Protected by namesMu.
+	lowercased map[string]string
+	// nameSources maps metric names to the first measurement and field
+	// producing them, to detect collisions. Protected by namesMu.
+	nameSources map[string]FieldKey
+	// nameTypes maps metric names to the type of their first sample as all
+	// the series of a metric must have the same. Protected by namesMu.
+	nameTypes map[string]prometheus.ValueType
+
+	mappingMu sync.RWMutex
+	mapping   *MappingConfig
+
+	// closeMu is held for reading while points are parsed so that Close
+	// doesn't close the channel during a send.
+	closeMu sync.RWMutex
+	closed  bool
+
+	lowercaseCollisions  prometheus.Counter
+	nameCollisions       prometheus.Counter
+	typeConflicts        prometheus.Counter
+	pointsTotal          prometheus.Counter
+	samplesTotal         prometheus.Counter
+	channelDepth         prometheus.GaugeFunc
+	channelDropped       prometheus.Counter
+	precisionLoss        prometheus.Counter
+	tooManyLabels        prometheus.Counter
+	droppedFields        prometheus.Counter
+	unsupportedFields    *prometheus.CounterVec
+	oldestSampleAgeDesc  *prometheus.Desc
+	collectTruncatedDesc *prometheus.Desc
+}
+
+// NewCollector returns a Collector. Run must be called for the parsed samples
+// to be stored.
+func NewCollector(cfg Config) *Collector {
+	c := &Collector{
+		cfg:         cfg,
+		mapping:     cfg.Mapping,
+		ch:          make(chan *Sample, cfg.ChannelBuffer),
+		samples:     map[string]*Sample{},
+		lowercased:  map[string]string{},
+		nameSources: map[string]FieldKey{},
+		nameTypes:   map[string]prometheus.ValueType{},
+		lowercaseCollisions: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "influxdb_exporter_lowercase_collisions_total",
+				Help: "Total number of metric or label names merged with a different name by lower-casing.",
+			},
+		),
+		nameCollisions: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "influxdb_exporter_name_collisions_total",
+				Help: "Total number of samples whose metric name is also produced by a different measurement and field.",
+			},
+		),
+		typeConflicts: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "influxdb_exporter_type_conflicts_total",
+				Help: "Total number of samples dropped because their metric name is already exported with a different type.",
+			},
+		),
+		pointsTotal: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "influxdb_exporter_points_total",
+				Help: "Total number of points parsed.",
+			},
+		),
+		samplesTotal: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "influxdb_exporter_samples_total",
+				Help: "Total number of samples produced from the parsed points.",
+			},
+		),
+		channelDropped: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "influxdb_exporter_channel_dropped_total",
+				Help: "Total number of samples dropped because the channel buffer was full.",
+			},
+		),
+		precisionLoss: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "influxdb_exporter_precision_loss_total",
+				Help: "Total number of integer fields whose magnitude is too large to be converted to a float without losing precision.",
+			},
+		),
+		tooManyLabels: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "influxdb_exporter_too_many_labels_total",
+				Help: "Total number of samples with more labels than allowed, dropped or truncated.",
+			},
+		),
+		droppedFields: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "influxdb_exporter_dropped_fields_total",
+				Help: "Total number of fields dropped because they aren't kept for their measurement.",
+			},
+		),
+		unsupportedFields: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "influxdb_exporter_unsupported_fields_total",
+				Help: "Total number of fields dropped because of an unsupported type.",
+			},
+			[]string{"type"},
+		),
+		oldestSampleAgeDesc: prometheus.NewDesc(
+			"influxdb_exporter_oldest_sample_age_seconds",
+			"Age of the oldest stored sample in seconds.",
+			nil, nil,
+		),
+		collectTruncatedDesc: prometheus.NewDesc(
+			"influxdb_exporter_collect_truncated",
+			"Whether the last collection was truncated to the maximum number of series.",
+			nil, nil,
+		),
+	}
+	c.channelDepth = prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "influxdb_exporter_channel_depth",
+			Help: "Number of samples queued in the channel buffer.",
+		},
+		func() float64 { return float64(len(c.ch)) },
+	)
+	for _, t := range []string{"string", "other"} {
+		c.unsupportedFields.WithLabelValues(t)
+	}
+	if cfg.PersistPath != "" {
+		if err := c.load(); err != nil {
+			log.Errorf("Error loading samples from %s: %s", cfg.PersistPath, err)
+		}
+	}
+	if c.cfg.NameSeparator == "" {
+		c.cfg.NameSeparator = "_"
+	}
+	if len(cfg.KeepTags) > 0 {
+		c.keepTags = make(map[string]struct{}, len(cfg.KeepTags))
+		for _, t := range cfg.KeepTags {
+			c.keepTags[invalidChars.ReplaceAllString(t, "_")] = struct{}{}
+		}
+	}
+	if len(cfg.KeepFields) > 0 {
+		c.keepFields = map[string]map[string]struct{}{}
+		for _, k := range cfg.KeepFields {
+			if c.keepFields[k.Measurement] == nil {
+				c.keepFields[k.Measurement] = map[string]struct{}{}
+			}
+			c.keepFields[k.Measurement][k.Field] = struct{}{}
+		}
+	}
+	return c
+}
+
+// ParsePoints converts points to samples.
+func (c *Collector) ParsePoints(points []models.Point) {
+	c.ParsePointsWithLabels(points, nil)
+}
+
+// ParsePointsWithLabels converts points to samples. The extra labels are added
+// to all samples on top of the point tags.
+func (c *Collector) ParsePointsWithLabels(points []models.Point, extraLabels map[string]string) {
+	c.closeMu.RLock()
+	defer c.closeMu.RUnlock()
+	if c.closed {
+		return
+	}
+
+	c.mappingMu.RLock()
+	mapping := c.mapping
+	c.mappingMu.RUnlock()
+
+	for _, s := range points {
+		c.pointsTotal.Inc()
+		fields, err := s.Fields()
+		if err != nil {
+			log.Errorf("error getting fields from point: %s", err)
+			continue
+		}
+		rule, measurement := mapping.match(string(s.Name()), s.Tags())
+		if keep, ok := c.keepFields[string(s.Name())]; ok {
+			// The fields are cached by the point, filter a copy.
+			kept := make(models.Fields, len(keep))
+			for field, v := range fields {
+				if _, ok := keep[field]; ok {
+					kept[field] = v
+				} else {
+					c.droppedFields.Inc()
+				}
+			}
+			fields = kept
+		}
+		bare := c.cfg.SingleFieldBareName && c.numericFields(fields) == 1
+		var expiry time.Duration
+		if c.cfg.ExpiryTag != "" {
+			if v := s.Tags().Get([]byte(c.cfg.ExpiryTag)); v != nil {
+				d, err := time.ParseDuration(string(v))
+				if err != nil || d <= 0 {
+					log.Errorf("invalid expiry %q for measurement %s", v, s.Name())
+				} else {
+					expiry = d
+				}
+			}
+		}
+		var n int
+		for field, v := range fields {
+			var (
+				value     float64
+				valueType = prometheus.UntypedValue
+			)
+			switch v := v.(type) {
+			case float64:
+				value = v
+			case int64:
+				if v >= maxExactInt || v <= -maxExactInt {
+					log.Debugf("Field %s of measurement %s has value %d which can't be represented exactly as a float", field, s.Name(), v)
+					c.precisionLoss.Inc()
+					if c.cfg.DropImprecise {
+						continue
+					}
+				}
+				value = float64(v)
+				if c.cfg.IntAsCounter {
+					valueType = prometheus.CounterValue
+				}
+			case bool:
+				if v {
+					value = 1
+				} else {
+					value = 0
+				}
+			case string:
+				if !c.cfg.CoerceNumericStrings {
+					c.unsupportedFields.WithLabelValues("string").Inc()
+					continue
+				}
+				f, ok := parseNumber(v)
+				if !ok {
+					c.unsupportedFields.WithLabelValues("string").Inc()
+					continue
+				}
+				value = f
+			default:
+				c.unsupportedFields.WithLabelValues("other").Inc()
+				continue
+			}
+
+			var name string
+			if field == "value" || c.cfg.FieldLabel != "" || bare {
+				name = measurement
+			} else {
+				name = measurement + c.cfg.NameSeparator + field
+			}
+
+			name = invalidChars.ReplaceAllString(name, "_")
+			if c.cfg.LowercaseNames {
+				name = c.lowercaseName(name)
+			}
+			src := FieldKey{measurement, field}
+			if c.cfg.FieldLabel != "" {
+				// All the fields of a measurement share the same name.
+				src.Field = ""
+			}
+			c.recordNameSource(name, src)
+
+			sample := &Sample{
+				Measurement: string(s.Name()),
+				Field:       field,
+				Name:        name,
+				Timestamp:   s.Time(),
+				Value:       value,
+				Type:        valueType,
+				Expiry:      expiry,
+				Labels:      map[string]string{},
+			}
+			if rule != nil && rule.Type != "" {
+				sample.Type = rule.valueType
+			}
+			if t, ok := c.cfg.TypeOverrides[FieldKey{sample.Measurement, field}]; ok {
+				sample.Type = t
+			}
+			// The tag keys and values are already unescaped by the parser.
+			for _, v := range s.Tags() {
+				if c.cfg.ExpiryTag != "" && string(v.Key) == c.cfg.ExpiryTag {
+					continue
+				}
+				if c.cfg.ExemplarTag != "" && string(v.Key) == c.cfg.ExemplarTag {
+					sample.Exemplar = string(v.Value)
+					continue
+				}
+				key := string(v.Key)
+				if l, ok := rule.label(key); ok {
+					key = l
+				} else {
+					key = c.trimTagKey(key)
+				}
+				key = invalidChars.ReplaceAllString(key, "_")
+				if c.keepTags != nil {
+					if _, ok := c.keepTags[key]; !ok {
+						continue
+					}
+				}
+				if c.cfg.LowercaseNames {
+					key = strings.ToLower(key)
+					if _, ok := sample.Labels[key]; ok {
+						c.lowercaseCollisions.Inc()
+					}
+				}
+				sample.Labels[key] = string(v.Value)
+			}
+			if c.cfg.FieldLabel != "" && field != "value" {
+				sample.Labels[c.cfg.FieldLabel] = field
+			}
+			for k, v := range extraLabels {
+				if tv, ok := sample.Labels[k]; ok {
+					log.Debugf("Label %s of measurement %s set by both a tag (%q) and an injected label (%q), tags precedence: %t", k, s.Name(), tv, v, c.cfg.TagsPrecedence)
+					if c.cfg.TagsPrecedence {
+						continue
+					}
+				}
+				sample.Labels[k] = v
+			}
+			if c.cfg.MaxLabels > 0 && len(sample.Labels) > c.cfg.MaxLabels {
+				c.tooManyLabels.Inc()
+				if c.cfg.MaxLabelsMode != MaxLabelsTruncate || !c.truncateLabels(sample.Labels, extraLabels) {
+					log.Debugf("Dropping sample %s with %d labels", sample.Name, len(sample.Labels))
+					continue
+				}
+			}
+			if c.cfg.InstanceLabelName != "" {
+				sample.Labels[c.cfg.InstanceLabelName] = c.cfg.InstanceLabelValue
+			}
+
+			// Calculate a consistent unique ID for the sample.
+			labelnames := make([]string, 0, len(sample.Labels))
+			for k := range sample.Labels {
+				labelnames = append(labelnames, k)
+			}
+			sort.Strings(labelnames)
+			parts := make([]string, 0, len(sample.Labels)*2+1)
+			parts = append(parts, sample.Name)
+			for _, l := range labelnames {
+				parts = append(parts, l, sample.Labels[l])
+			}
+			sample.ID = fmt.Sprintf("%q", parts)
+
+			if !c.recordNameType(sample.Name, sample.Type) {
+				log.Debugf("Dropping sample %s, metric %s already has a different type", sample.ID, sample.Name)
+				continue
+			}
+			if c.cfg.DropOnFull {
+				select {
+				case c.ch <- sample:
+				default:
+					c.channelDropped.Inc()
+					continue
+				}
+			} else {
+				c.ch <- sample
+			}
+			n++
+			c.samplesTotal.Inc()
+		}
+		if n == 0 {
+			log.Debugf("Point of measurement %s produced no sample", s.Name())
+		}
+	}
+}
+
+// parseNumber parses a numeric string field. NaN and infinities, which
+// ParseFloat accepts, aren't considered numbers.
+func parseNumber(s string) (float64, bool) {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, false
+	}
+	return f, true
+}
+
+// numericFields returns the number of fields converted to samples.
+func (c *Collector) numericFields(fields models.Fields) int {
+	var n int
+	for _, v := range fields {
+		switch v := v.(type) {
+		case float64, int64, bool:
+			n++
+		case string:
+			if c.cfg.CoerceNumericStrings {
+				if _, ok := parseNumber(v); ok {
+					n++
+				}
+			}
+		}
+	}
+	return n
+}
+
+// truncateLabels removes the labels set by tags after the first ones in
+// alphabetical order to keep MaxLabels labels. The field label and the extra
+// labels are never removed, it reports false if they exceed MaxLabels alone.
+func (c *Collector) truncateLabels(labels map[string]string, extraLabels map[string]string) bool {
+	var (
+		tags      = make([]string, 0, len(labels))
+		protected int
+	)
+	for k := range labels {
+		if _, ok := extraLabels[k]; ok || (c.cfg.FieldLabel != "" && k == c.cfg.FieldLabel) {
+			protected++
+			continue
+		}
+		tags = append(tags, k)
+	}
+	keep := c.cfg.MaxLabels - protected
+	if keep < 0 {
+		return false
+	}
+	sort.Strings(tags)
+	for _, k := range tags[keep:] {
+		delete(labels, k)
+	}
+	return true
+}
+
+// trimTagKey removes the configured prefix and suffix from the tag key,
+// returning the key unchanged if nothing would be left.
+func (c *Collector) trimTagKey(key string) string {
+	trimmed := strings.TrimSuffix(strings.TrimPrefix(key, c.cfg.TagKeyTrimPrefix), c.cfg.TagKeyTrimSuffix)
+	if trimmed == "" {
+		return key
+	}
+	return trimmed
+}
+
+// SetMapping replaces the mapping configuration used for the next points.
+// Stored samples are left untouched.
+func (c *Collector) SetMapping(m *MappingConfig) {
+	c.mappingMu.Lock()
+	defer c.mappingMu.Unlock()
+	c.mapping = m
+}
+
+// Run stores the parsed samples and garbage collects the expired ones. It
+// returns once Close has been called and all queued samples are stored.
+func (c *Collector) Run() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case s, ok := <-c.ch:
+			if !ok {
+				c.persist()
+				return
+			}
+			c.store(s)
+
+		case <-ticker.C:
+			c.gc(time.Now())
+			c.persist()
+		}
+	}
+}
+
+// gc deletes the stale samples and forgets the names no sample uses anymore.
+func (c *Collector) gc(now time.Time) {
+	c.mu.Lock()
+	names := make(map[string]struct{}, len(c.samples))
+	for k, sample := range c.samples {
+		if c.stale(sample, now) {
+			delete(c.samples, k)
+			continue
+		}
+		names[sample.Name] = struct{}{}
+	}
+	c.mu.Unlock()
+
+	c.namesMu.Lock()
+	defer c.namesMu.Unlock()
+	for name := range c.lowercased {
+		if _, ok := names[name]; !ok {
+			delete(c.lowercased, name)
+		}
+	}
+	for name := range c.nameSources {
+		if _, ok := names[name]; !ok {
+			delete(c.nameSources, name)
+		}
+	}
+	for name := range c.nameTypes {
+		if _, ok := names[name]; !ok {
+			delete(c.nameTypes, name)
+		}
+	}
+}
+
+// persist saves the samples if PersistPath is set.
+func (c *Collector) persist() {
+	if c.cfg.PersistPath == "" {
+		return
+	}
+	if err := c.save(); err != nil {
+		log.Errorf("Error saving samples to %s: %s", c.cfg.PersistPath, err)
+	}
+}
+
+// store inserts the sample according to the dedup mode.
+func (c *Collector) store(s *Sample) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	old, ok := c.samples[s.ID]
+	if !ok {
+		c.samples[s.ID] = s
+		return
+	}
+	// A stale sample is replaced as if the series was new.
+	if c.stale(old, time.Now()) {
+		c.samples[s.ID] = s
+		return
+	}
+	if c.cfg.SkipIdentical && old.Value == s.Value {
+		return
+	}
+	switch c.cfg.DedupMode {
+	case DedupLatestTimestamp:
+		if s.Timestamp.Before(old.Timestamp) {
+			return
+		}
+	case DedupMax, DedupSum:
+		merged := *s
+		if c.cfg.DedupMode == DedupSum {
+			merged.Value += old.Value
+		} else if old.Value > s.Value {
+			merged.Value = old.Value
+		}
+		if old.Timestamp.After(s.Timestamp) {
+			merged.Timestamp = old.Timestamp
+		}
+		s = &merged
+	}
+	c.samples[s.ID] = s
+}
+
+// Close stops Run once the queued samples are stored. Points parsed after
+// Close are dropped.
+func (c *Collector) Close() {
+	c.closeMu.Lock()
+	defer c.closeMu.Unlock()
+	if !c.closed {
+		c.closed = true
+		close(c.ch)
+	}
+}
+
+// Samples returns the stored samples ordered by ID, including the expired
+// samples not yet garbage collected.
+func (c *Collector) Samples() []*Sample {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.sortedSamples()
+}
+
+// sortedSamples returns the stored samples ordered by ID. It must be called
+// with mu held.
+func (c *Collector) sortedSamples() []*Sample {
+	samples := make([]*Sample, 0, len(c.samples))
+	for _, sample := range c.samples {
+		samples = append(samples, sample)
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i].ID < samples[j].ID })
+	return samples
+}
+
+// lowercaseName returns the lower-cased name, recording collisions between
+// names that only differ by case.
+func (c *Collector) lowercaseName(name string) string {
+	lower := strings.ToLower(name)
+	c.namesMu.Lock()
+	defer c.namesMu.Unlock()
+	if orig, ok := c.lowercased[lower]; !ok {
+		c.lowercased[lower] = name
+	} else if orig != name {
+		c.lowercaseCollisions.Inc()
+	}
+	return lower
+}
+
+// recordNameSource records the measurement and field producing the metric
+// name, counting collisions with a different source. The measurement is the
+// one rewritten by the mapping so that rules merging measurements on purpose
+// don't count as collisions.
+func (c *Collector) recordNameSource(name string, src FieldKey) {
+	c.namesMu.Lock()
+	defer c.namesMu.Unlock()
+	if orig, ok := c.nameSources[name]; !ok {
+		c.nameSources[name] = src
+	} else if orig != src {
+		log.Debugf("Metric name %s produced by field %s of measurement %s collides with field %s of measurement %s", name, src.Field, src.Measurement, orig.Field, orig.Measurement)
+		c.nameCollisions.Inc()
+	}
+}
+
+// recordNameType records the type of the metric name, counting and reporting
+// as false the samples whose type differs from the one recorded.
+func (c *Collector) recordNameType(name string, t prometheus.ValueType) bool {
+	c.namesMu.Lock()
+	defer c.namesMu.Unlock()
+	if orig, ok := c.nameTypes[name]; !ok {
+		c.nameTypes[name] = t
+	} else if orig != t {
+		c.typeConflicts.Inc()
+		return false
+	}
+	return true
+}
+
+// Stats summarizes the stored samples.
+type Stats struct {
+	// Series is the number of stored series, including the expired ones
+	// not garbage collected yet.
+	Series int
+	// OldestSampleAge and NewestSampleAge are the ages of the oldest and
+	// most recent samples, 0 if there is none.
+	OldestSampleAge time.Duration
+	NewestSampleAge time.Duration
+}
+
+// Stats returns statistics about the stored samples.
+func (c *Collector) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var oldest, newest time.Time
+	for _, sample := range c.samples {
+		if oldest.IsZero() || sample.Timestamp.Before(oldest) {
+			oldest = sample.Timestamp
+		}
+		if sample.Timestamp.After(newest) {
+			newest = sample.Timestamp
+		}
+	}
+	st := Stats{Series: len(c.samples)}
+	if len(c.samples) > 0 {
+		st.OldestSampleAge = time.Since(oldest)
+		st.NewestSampleAge = time.Since(newest)
+	}
+	return st
+}
+
+// oldestSampleAge returns the age in seconds of the oldest stored sample, or 0
+// if there is none.
+func (c *Collector) oldestSampleAge() float64 {
+	return c.Stats().OldestSampleAge.Seconds()
+}
+
+// Collect implements prometheus.Collector.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	c.lowercaseCollisions.Collect(ch)
+	c.nameCollisions.Collect(ch)
+	c.typeConflicts.Collect(ch)
+	c.pointsTotal.Collect(ch)
+	c.samplesTotal.Collect(ch)
+	c.channelDepth.Collect(ch)
+	c.channelDropped.Collect(ch)
+	c.precisionLoss.Collect(ch)
+	c.tooManyLabels.Collect(ch)
+	c.droppedFields.Collect(ch)
+	c.unsupportedFields.Collect(ch)
+	ch <- prometheus.MustNewConstMetric(c.oldestSampleAgeDesc, prometheus.GaugeValue, c.oldestSampleAge())
+
+	var truncated float64
+	if c.collectSamples(ch, collectOptions{}) {
+		truncated = 1
+	}
+	ch <- prometheus.MustNewConstMetric(c.collectTruncatedDesc, prometheus.GaugeValue, truncated)
+}
+
+// collectOptions qualifies the samples sent by collectSamples.
+type collectOptions struct {
+	// measurement restricts the samples to the ones of the measurement if
+	// not empty.
+	measurement string
+	// readOnly doesn't mark the samples as collected, so that the ones served
+	// once or retained until collected are kept.
+	readOnly bool
+	// stale includes the stale samples.
+	stale bool
+}
+
+// collectSamples sends the samples to be exported. It reports whether the
+// samples have been truncated to MaxCollectSeries.
+func (c *Collector) collectSamples(ch chan<- prometheus.Metric, opts collectOptions) bool {
+	var (
+		now       = time.Now()
+		truncated bool
+	)
+	c.mu.Lock()
+	var samples []*Sample
+	if c.cfg.MaxCollectSeries > 0 {
+		// Sort the samples to truncate to the same series every time.
+		samples = c.sortedSamples()
+	} else {
+		samples = make([]*Sample, 0, len(c.samples))
+		for _, sample := range c.samples {
+			samples = append(samples, sample)
+		}
+	}
+	exported := samples[:0]
+	for _, sample := range samples {
+		if (!opts.stale && c.stale(sample, now)) || (opts.measurement != "" && sample.Measurement != opts.measurement) {
+			continue
+		}
+		if c.cfg.MaxCollectSeries > 0 && len(exported) >= c.cfg.MaxCollectSeries {
+			truncated = true
+			break
+		}
+		if !opts.readOnly {
+			sample.served = true
+			if sample.expired(now, c.cfg.SampleExpiry) {
+				sample.servedExpired = true
+			}
+			if c.serveOnce(sample) {
+				delete(c.samples, sample.ID)
+			}
+		}
+		exported = append(exported, sample)
+	}
+	c.mu.Unlock()
+
+	if c.cfg.DetectHistograms {
+		var histograms []prometheus.Metric
+		histograms, exported = c.histograms(exported)
+		for _, m := range histograms {
+			ch <- m
+		}
+	}
+	if c.cfg.DetectSummaries {
+		var summaries []prometheus.Metric
+		summaries, exported = c.summaries(exported)
+		for _, m := range summaries {
+			ch <- m
+		}
+	}
+	for _, sample := range exported {
+		metric := prometheus.MustNewConstMetric(
+			prometheus.NewDesc(sample.Name, "InfluxDB Metric", []string{}, sample.Labels),
+			sample.Type,
+			sample.Value,
+		)
+
+		// OpenMetrics only allows exemplars on the _total series of counters.
+		if sample.Exemplar != "" && sample.Type == prometheus.CounterValue && strings.HasSuffix(sample.Name, "_total") {
+			metric = c.withExemplar(metric, sample)
+		}
+		if c.cfg.ExportTimestamp {
+			metric = prometheus.NewMetricWithTimestamp(sample.Timestamp, metric)
+		}
+		ch <- metric
+	}
+	return truncated
+}
+
+// Measurement returns a collector exporting only the samples of the
+// measurement, without the internal metrics. Collecting it doesn't count as a
+// scrape for the samples served once or retained until collected.
+func (c *Collector) Measurement(measurement string) prometheus.Collector {
+	return samplesCollector{c: c, opts: collectOptions{measurement: measurement, readOnly: true}}
+}
+
+// AllSamples returns a collector exporting all the stored samples regardless
+// of their age, without the internal metrics. Like Measurement, collecting it
+// doesn't count as a scrape.
+func (c *Collector) AllSamples() prometheus.Collector {
+	return samplesCollector{c: c, opts: collectOptions{readOnly: true, stale: true}}
+}
+
+type samplesCollector struct {
+	c    *Collector
+	opts collectOptions
+}
+
+// Collect implements prometheus.Collector.
+func (s samplesCollector) Collect(ch chan<- prometheus.Metric) {
+	s.c.collectSamples(ch, s.opts)
+}
+
+// Describe implements prometheus.Collector. Nothing is described as the
+// samples are only known at collection time.
+func (s samplesCollector) Describe(ch chan<- *prometheus.Desc) {}
+
+// exemplarMetric is a counter with an exemplar.
+type exemplarMetric struct {
+	prometheus.Metric
+	exemplar *dto.Exemplar
+}
+
+// Write implements prometheus.Metric.
+func (m exemplarMetric) Write(pb *dto.Metric) error {
+	if err := m.Metric.Write(pb); err != nil {
+		return err
+	}
+	if pb.Counter != nil {
+		pb.Counter.Exemplar = m.exemplar
+	}
+	return nil
+}
+
+// withExemplar attaches the exemplar of the sample to the counter metric. The
+// exemplar is dropped if client_golang would reject it.
+func (c *Collector) withExemplar(m prometheus.Metric, s *Sample) prometheus.Metric {
+	ts, err := ptypes.TimestampProto(s.Timestamp)
+	if err != nil {
+		log.Debugf("Invalid exemplar timestamp for %s: %s", s.Name, err)
+		return m
+	}
+	name := invalidChars.ReplaceAllString(c.cfg.ExemplarTag, "_")
+	if !utf8.ValidString(s.Exemplar) {
+		log.Debugf("Dropping exemplar of %s, %q is not valid UTF-8", s.ID, s.Exemplar)
+		return m
+	}
+	if runes := utf8.RuneCountInString(name) + utf8.RuneCountInString(s.Exemplar); runes > prometheus.ExemplarMaxRunes {
+		log.Debugf("Dropping exemplar of %s, its label has %d runes, more than %d", s.ID, runes, prometheus.ExemplarMaxRunes)
+		return m
+	}
+	return exemplarMetric{
+		Metric: m,
+		exemplar: &dto.Exemplar{
+			Label:     []*dto.LabelPair{{Name: &name, Value: &s.Exemplar}},
+			Value:     &s.Value,
+			Timestamp: ts,
+		},
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	c.lowercaseCollisions.Describe(ch)
+	c.nameCollisions.Describe(ch)
+	c.typeConflicts.Describe(ch)
+	c.pointsTotal.Describe(ch)
+	c.samplesTotal.Describe(ch)
+	c.channelDepth.Describe(ch)
+	c.channelDropped.Describe(ch)
+	c.precisionLoss.Describe(ch)
+	c.tooManyLabels.Describe(ch)
+	c.droppedFields.Describe(ch)
+	c.unsupportedFields.Describe(ch)
+	ch <- c.oldestSampleAgeDesc
+	ch <- c.collectTruncatedDesc
+}
@@ -0,0 +1,888 @@
+// Copyright 2016 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/influxdata/influxdb/models"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
+
+	"github.com/prometheus/influxdb_exporter/internal/logtest"
+)
+
+// newTestCollector returns a collector with a channel buffer large enough for
+// the samples of a test to be queued without Run.
+func newTestCollector(cfg Config) *Collector {
+	if cfg.ChannelBuffer == 0 {
+		cfg.ChannelBuffer = 1000
+	}
+	if cfg.SampleExpiry == 0 {
+		cfg.SampleExpiry = 5 * time.Minute
+	}
+	return NewCollector(cfg)
+}
+
+// parse converts the line protocol and stores the queued samples.
+func parse(t *testing.T, c *Collector, lp string) {
+	t.Helper()
+	points, err := models.ParsePointsWithPrecision([]byte(lp), time.Now(), "ns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.ParsePoints(points)
+	drain(c)
+}
+
+// drain stores the queued samples like Run does.
+func drain(c *Collector) {
+	for len(c.ch) > 0 {
+		c.store(<-c.ch)
+	}
+}
+
+// series returns the stored series in the name{labels} form.
+func series(c *Collector) []string {
+	var series []string
+	for _, s := range c.Samples() {
+		m := model.Metric{model.MetricNameLabel: model.LabelValue(s.Name)}
+		for k, v := range s.Labels {
+			m[model.LabelName(k)] = model.LabelValue(v)
+		}
+		series = append(series, m.String())
+	}
+	return series
+}
+
+// compare checks the exposition of the metrics with the given names.
+func compare(t *testing.T, c prometheus.Collector, expected string, names ...string) {
+	t.Helper()
+	reg := prometheus.NewRegistry()
+	if err := reg.Register(c); err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(expected), names...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNoSampleProduced(t *testing.T) {
+	if err := log.Base().SetLevel("debug"); err != nil {
+		t.Fatal(err)
+	}
+	defer log.Base().SetLevel("info")
+	hook := logtest.NewHook()
+
+	c := newTestCollector(Config{})
+	parse(t, c, `cpu,host=a name="idle"`)
+	if n := len(hook.Logged("Point of measurement cpu produced no sample")); n != 1 {
+		t.Fatalf("expected the point to be logged once, got %d times", n)
+	}
+	if n := len(c.Samples()); n != 0 {
+		t.Fatalf("expected no sample, got %d", n)
+	}
+	if v := testutil.ToFloat64(c.samplesTotal); v != 0 {
+		t.Fatalf("expected 0 samples produced, got %v", v)
+	}
+}
+
+func TestDroppedSamplesNotCounted(t *testing.T) {
+	c := NewCollector(Config{SampleExpiry: time.Minute, ChannelBuffer: 1, DropOnFull: true})
+	parse(t, c, "cpu idle=1,user=2,system=3")
+	if v := testutil.ToFloat64(c.samplesTotal); v != 1 {
+		t.Fatalf("expected 1 queued sample, got %v", v)
+	}
+	if v := testutil.ToFloat64(c.channelDropped); v != 2 {
+		t.Fatalf("expected 2 dropped samples, got %v", v)
+	}
+}
+
+func TestChannelDepth(t *testing.T) {
+	c := NewCollector(Config{SampleExpiry: time.Minute, ChannelBuffer: 3, DropOnFull: true})
+	points, err := models.ParsePoints([]byte("cpu idle=1,user=2,system=3,nice=4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.ParsePoints(points)
+
+	compare(t, c, `
+# HELP influxdb_exporter_channel_depth Number of samples queued in the channel buffer.
+# TYPE influxdb_exporter_channel_depth gauge
+influxdb_exporter_channel_depth 3
+# HELP influxdb_exporter_channel_dropped_total Total number of samples dropped because the channel buffer was full.
+# TYPE influxdb_exporter_channel_dropped_total counter
+influxdb_exporter_channel_dropped_total 1
+`, "influxdb_exporter_channel_depth", "influxdb_exporter_channel_dropped_total")
+
+	drain(c)
+	if v := testutil.ToFloat64(c.channelDepth); v != 0 {
+		t.Fatalf("expected an empty channel once drained, got %v", v)
+	}
+}
+
+func TestMaxCollectSeries(t *testing.T) {
+	for _, tc := range []struct {
+		max       int
+		expected  string
+		truncated float64
+	}{
+		{
+			max: 0,
+			expected: `
+# HELP cpu InfluxDB Metric
+# TYPE cpu untyped
+cpu{host="a"} 1
+cpu{host="b"} 2
+cpu{host="c"} 3
+`,
+		},
+		{
+			max: 2,
+			expected: `
+# HELP cpu InfluxDB Metric
+# TYPE cpu untyped
+cpu{host="a"} 1
+cpu{host="b"} 2
+`,
+			truncated: 1,
+		},
+	} {
+		c := newTestCollector(Config{MaxCollectSeries: tc.max})
+		parse(t, c, "cpu,host=c value=3\ncpu,host=a value=1\ncpu,host=b value=2")
+		compare(t, c, tc.expected, "cpu")
+		if c.cfg.MaxCollectSeries > 0 {
+			// The same series are kept on every collection.
+			compare(t, c, tc.expected, "cpu")
+		}
+		compare(t, c, fmt.Sprintf(`
+# HELP influxdb_exporter_collect_truncated Whether the last collection was truncated to the maximum number of series.
+# TYPE influxdb_exporter_collect_truncated gauge
+influxdb_exporter_collect_truncated %v
+`, tc.truncated), "influxdb_exporter_collect_truncated")
+	}
+}
+
+func TestSkipIdentical(t *testing.T) {
+	var (
+		now   = time.Now()
+		fresh = now.Add(-time.Minute)
+		old   = now.Add(-10 * time.Minute)
+	)
+	for _, tc := range []struct {
+		name     string
+		stored   time.Time
+		expected time.Time
+	}{
+		{name: "fresh sample kept", stored: fresh, expected: fresh},
+		{name: "stale sample replaced", stored: old, expected: now},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newTestCollector(Config{SkipIdentical: true})
+			parse(t, c, fmt.Sprintf("cpu value=1 %d", tc.stored.UnixNano()))
+			parse(t, c, fmt.Sprintf("cpu value=1 %d", now.UnixNano()))
+			samples := c.Samples()
+			if len(samples) != 1 {
+				t.Fatalf("expected 1 sample, got %d", len(samples))
+			}
+			if !samples[0].Timestamp.Equal(tc.expected) {
+				t.Fatalf("expected timestamp %s, got %s", tc.expected, samples[0].Timestamp)
+			}
+		})
+	}
+}
+
+func TestDedupModes(t *testing.T) {
+	var (
+		now    = time.Now()
+		recent = now.Add(-time.Minute)
+		older  = now.Add(-2 * time.Minute)
+		stale  = now.Add(-10 * time.Minute)
+	)
+	type point struct {
+		value float64
+		ts    time.Time
+	}
+	for _, tc := range []struct {
+		mode     string
+		points   []point
+		value    float64
+		expected time.Time
+	}{
+		// Out of order points.
+		{mode: DedupLastWrite, points: []point{{2, recent}, {1, older}}, value: 1, expected: older},
+		{mode: DedupLatestTimestamp, points: []point{{2, recent}, {1, older}}, value: 2, expected: recent},
+		{mode: DedupMax, points: []point{{2, recent}, {1, older}}, value: 2, expected: recent},
+		{mode: DedupMax, points: []point{{1, recent}, {2, older}}, value: 2, expected: recent},
+		{mode: DedupSum, points: []point{{2, recent}, {1, older}}, value: 3, expected: recent},
+		// Stale samples aren't merged.
+		{mode: DedupMax, points: []point{{5, stale}, {1, recent}}, value: 1, expected: recent},
+		{mode: DedupSum, points: []point{{5, stale}, {1, recent}}, value: 1, expected: recent},
+	} {
+		c := newTestCollector(Config{DedupMode: tc.mode})
+		for _, p := range tc.points {
+			parse(t, c, fmt.Sprintf("cpu value=%v %d", p.value, p.ts.UnixNano()))
+		}
+		samples := c.Samples()
+		if len(samples) != 1 {
+			t.Fatalf("%s: expected 1 sample, got %d", tc.mode, len(samples))
+		}
+		if samples[0].Value != tc.value || !samples[0].Timestamp.Equal(tc.expected) {
+			t.Fatalf("%s: expected %v at %s, got %v at %s", tc.mode, tc.value, tc.expected, samples[0].Value, samples[0].Timestamp)
+		}
+	}
+}
+
+func TestMinRetention(t *testing.T) {
+	c := newTestCollector(Config{SampleExpiry: time.Hour, MinRetention: true})
+	parse(t, c, fmt.Sprintf("cpu value=1 %d", time.Now().Add(-30*time.Minute).UnixNano()))
+
+	// Collected before its expiry.
+	compare(t, c, "# HELP cpu InfluxDB Metric\n# TYPE cpu untyped\ncpu 1\n", "cpu")
+
+	// Samples served before their expiry are still kept once expired.
+	s := c.Samples()[0]
+	s.Timestamp = time.Now().Add(-2 * time.Hour)
+	if c.stale(s, time.Now()) {
+		t.Fatal("expired sample not collected since its expiry is stale")
+	}
+	compare(t, c, "# HELP cpu InfluxDB Metric\n# TYPE cpu untyped\ncpu 1\n", "cpu")
+	if !c.stale(s, time.Now()) {
+		t.Fatal("expired sample collected since its expiry isn't stale")
+	}
+	compare(t, c, "", "cpu")
+}
+
+func TestZeroExpiryServesOnce(t *testing.T) {
+	c := NewCollector(Config{ChannelBuffer: 10, ExpiryTag: "__expiry__"})
+	// Old samples are served too, and the expiry tag opts out of serving once.
+	parse(t, c, fmt.Sprintf("cpu value=1 %d\nmem,__expiry__=1h value=2", time.Now().Add(-time.Hour).UnixNano()))
+
+	compare(t, c, "# HELP cpu InfluxDB Metric\n# TYPE cpu untyped\ncpu 1\n# HELP mem InfluxDB Metric\n# TYPE mem untyped\nmem 2\n", "cpu", "mem")
+	compare(t, c, "# HELP mem InfluxDB Metric\n# TYPE mem untyped\nmem 2\n", "cpu", "mem")
+
+	// Samples not scraped yet survive the garbage collection.
+	parse(t, c, "disk value=3")
+	c.gc(time.Now())
+	compare(t, c, "# HELP disk InfluxDB Metric\n# TYPE disk untyped\ndisk 3\n", "disk")
+	c.gc(time.Now())
+	if got := series(c); fmt.Sprint(got) != "[mem]" {
+		t.Fatalf("expected only mem after the garbage collection, got %v", got)
+	}
+}
+
+func TestMeasurementReadOnly(t *testing.T) {
+	c := NewCollector(Config{ChannelBuffer: 10})
+	parse(t, c, "cpu value=1\nmem value=2")
+
+	for i := 0; i < 2; i++ {
+		compare(t, c.Measurement("cpu"), "# HELP cpu InfluxDB Metric\n# TYPE cpu untyped\ncpu 1\n")
+	}
+	if n := len(c.Samples()); n != 2 {
+		t.Fatalf("expected 2 samples after scraping a measurement, got %d", n)
+	}
+
+	compare(t, c, "# HELP cpu InfluxDB Metric\n# TYPE cpu untyped\ncpu 1\n# HELP mem InfluxDB Metric\n# TYPE mem untyped\nmem 2\n", "cpu", "mem")
+	if n := len(c.Samples()); n != 0 {
+		t.Fatalf("expected the samples to be served once, got %d left", n)
+	}
+}
+
+func TestGCForgetsNames(t *testing.T) {
+	c := newTestCollector(Config{LowercaseNames: true})
+	parse(t, c, "CPU value=1")
+	parse(t, c, fmt.Sprintf("mem value=1 %d", time.Now().Add(-time.Hour).UnixNano()))
+	c.gc(time.Now())
+
+	if _, ok := c.lowercased["cpu"]; !ok {
+		t.Fatal("name of a stored sample forgotten")
+	}
+	if _, ok := c.nameSources["cpu"]; !ok {
+		t.Fatal("source of a stored sample forgotten")
+	}
+	if _, ok := c.lowercased["mem"]; ok {
+		t.Fatal("name of a garbage collected sample not forgotten")
+	}
+	if _, ok := c.nameSources["mem"]; ok {
+		t.Fatal("source of a garbage collected sample not forgotten")
+	}
+}
+
+func TestNameCollisions(t *testing.T) {
+	c := newTestCollector(Config{})
+	// All three produce disk_io_reads, more writes of a field don't collide.
+	parse(t, c, "disk_io,host=a reads=1\ndisk_io,host=a reads=2\ndisk,device=sda io_reads=3\ndisk-io,host=b reads=4")
+
+	compare(t, c, `
+# HELP influxdb_exporter_name_collisions_total Total number of samples whose metric name is also produced by a different measurement and field.
+# TYPE influxdb_exporter_name_collisions_total counter
+influxdb_exporter_name_collisions_total 2
+`, "influxdb_exporter_name_collisions_total")
+	expected := `[disk_io_reads{device="sda"} disk_io_reads{host="a"} disk_io_reads{host="b"}]`
+	if got := series(c); fmt.Sprint(got) != expected {
+		t.Fatalf("expected %s, got %v", expected, got)
+	}
+}
+
+func TestTypeConflicts(t *testing.T) {
+	c := newTestCollector(Config{
+		IntAsCounter:  true,
+		TypeOverrides: map[FieldKey]prometheus.ValueType{{"disk", "value"}: prometheus.GaugeValue},
+	})
+	// All the series of a metric must have the type of the first one.
+	parse(t, c, "requests,path=a value=1i\nrequests,path=b value=2.5")
+	parse(t, c, "disk,dev=a value=3i\ndisk,dev=b value=4")
+
+	compare(t, c, `
+# HELP disk InfluxDB Metric
+# TYPE disk gauge
+disk{dev="a"} 3
+disk{dev="b"} 4
+# HELP influxdb_exporter_type_conflicts_total Total number of samples dropped because their metric name is already exported with a different type.
+# TYPE influxdb_exporter_type_conflicts_total counter
+influxdb_exporter_type_conflicts_total 1
+# HELP requests InfluxDB Metric
+# TYPE requests counter
+requests{path="a"} 1
+`, "disk", "requests", "influxdb_exporter_type_conflicts_total")
+}
+
+func TestMaxLabelsTruncate(t *testing.T) {
+	c := newTestCollector(Config{MaxLabels: 3, MaxLabelsMode: MaxLabelsTruncate, FieldLabel: "field"})
+	points, err := models.ParsePointsWithPrecision([]byte("cpu,a=1,b=2,c=3 idle=1\nmem,a=1 free=1"), time.Now(), "ns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.ParsePointsWithLabels(points, map[string]string{"source": "x"})
+	// Too many labels even without the tags.
+	c.ParsePointsWithLabels(points[1:], map[string]string{"source": "x", "rp": "y", "db": "z"})
+	drain(c)
+
+	compare(t, c, `
+# HELP cpu InfluxDB Metric
+# TYPE cpu untyped
+cpu{a="1",field="idle",source="x"} 1
+# HELP mem InfluxDB Metric
+# TYPE mem untyped
+mem{a="1",field="free",source="x"} 1
+`, "cpu", "mem")
+	// The truncated cpu sample and the dropped mem one.
+	if v := testutil.ToFloat64(c.tooManyLabels); v != 2 {
+		t.Fatalf("expected 2 samples with too many labels, got %v", v)
+	}
+}
+
+func TestMaxLabelsDrop(t *testing.T) {
+	c := newTestCollector(Config{MaxLabels: 2, MaxLabelsMode: MaxLabelsDrop})
+	parse(t, c, "cpu,a=1,b=2,c=3 idle=1,user=2\nmem,a=1,b=2 free=1")
+
+	if got := series(c); fmt.Sprint(got) != `[mem_free{a="1", b="2"}]` {
+		t.Fatalf("expected only the mem sample, got %v", got)
+	}
+	compare(t, c, `
+# HELP influxdb_exporter_too_many_labels_total Total number of samples with more labels than allowed, dropped or truncated.
+# TYPE influxdb_exporter_too_many_labels_total counter
+influxdb_exporter_too_many_labels_total 2
+`, "influxdb_exporter_too_many_labels_total")
+}
+
+func TestExemplarValidation(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		exemplar string
+		expected bool
+	}{
+		{name: "valid", exemplar: "abc123", expected: true},
+		{name: "too long", exemplar: strings.Repeat("é", prometheus.ExemplarMaxRunes-len("trace_id")+1)},
+		{name: "largest", exemplar: strings.Repeat("é", prometheus.ExemplarMaxRunes-len("trace_id")), expected: true},
+		{name: "invalid UTF-8", exemplar: "\xff"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newTestCollector(Config{ExemplarTag: "trace_id", IntAsCounter: true})
+			m := c.withExemplar(prometheus.MustNewConstMetric(
+				prometheus.NewDesc("requests", "InfluxDB Metric", nil, nil), prometheus.CounterValue, 1,
+			), &Sample{ID: "requests", Name: "requests", Value: 1, Timestamp: time.Now(), Exemplar: tc.exemplar})
+
+			var pb dto.Metric
+			if err := m.Write(&pb); err != nil {
+				t.Fatal(err)
+			}
+			if got := pb.GetCounter().GetExemplar() != nil; got != tc.expected {
+				t.Fatalf("expected exemplar %t, got %t", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestPersist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "influxdb_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "samples.json")
+
+	c := NewCollector(Config{SampleExpiry: time.Hour, PersistPath: path})
+	points, err := models.ParsePointsWithPrecision([]byte("cpu,host=a idle=1,user=2i\nmem,host=a free=3"), time.Now(), "ns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		c.ParsePoints(points)
+		c.Close()
+	}()
+	// Run saves the samples once closed.
+	c.Run()
+	saved := c.Samples()
+	// JSON numbers can't represent NaN and infinities.
+	saved[0].Value = math.Inf(1)
+	saved[1].Value = math.NaN()
+	if err := c.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := NewCollector(Config{SampleExpiry: time.Hour, PersistPath: path}).Samples()
+	if len(loaded) != len(saved) {
+		t.Fatalf("expected %d samples, got %d", len(saved), len(loaded))
+	}
+	for i, s := range saved {
+		l := loaded[i]
+		sameValue := l.Value == s.Value || math.IsNaN(l.Value) && math.IsNaN(s.Value)
+		if l.ID != s.ID || l.Name != s.Name || !sameValue || l.Type != s.Type || !l.Timestamp.Equal(s.Timestamp) || !reflect.DeepEqual(l.Labels, s.Labels) {
+			t.Fatalf("expected sample %+v, got %+v", s, l)
+		}
+	}
+}
+
+func TestEscapedTags(t *testing.T) {
+	c := newTestCollector(Config{})
+	parse(t, c, `m,a=x\ y,b=c\,d,e=f\=g,q="quoted",s=back\slash,u=héllo v=1`)
+
+	compare(t, c, `
+# HELP m_v InfluxDB Metric
+# TYPE m_v untyped
+m_v{a="x y",b="c,d",e="f=g",q="\"quoted\"",s="back\\slash",u="héllo"} 1
+`, "m_v")
+}
+
+func TestKeepTags(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		keep     []string
+		expected string
+	}{
+		{
+			name:     "all tags",
+			expected: `cpu_idle{dc="eu",host="a",instance_id="i-1",rack="r1",source="x"} 1`,
+		},
+		{
+			name:     "keep only",
+			keep:     []string{"host", "dc"},
+			expected: `cpu_idle{dc="eu",host="a",source="x"} 1`,
+		},
+		{
+			// The allow-list matches the sanitized keys.
+			name:     "sanitized keys",
+			keep:     []string{"instance-id"},
+			expected: `cpu_idle{instance_id="i-1",source="x"} 1`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newTestCollector(Config{KeepTags: tc.keep})
+			points, err := models.ParsePoints([]byte("cpu,host=a,dc=eu,rack=r1,instance-id=i-1 idle=1"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Injected labels aren't filtered.
+			c.ParsePointsWithLabels(points, map[string]string{"source": "x"})
+			drain(c)
+			compare(t, c, "# HELP cpu_idle InfluxDB Metric\n# TYPE cpu_idle untyped\n"+tc.expected+"\n", "cpu_idle")
+		})
+	}
+}
+
+func TestExpiryTag(t *testing.T) {
+	c := newTestCollector(Config{SampleExpiry: 5 * time.Minute, ExpiryTag: "__expiry__"})
+	ts := time.Now().Add(-2 * time.Minute).UnixNano()
+	parse(t, c, fmt.Sprintf(`fast,__expiry__=1m value=1 %d
+slow,__expiry__=1h value=2 %d
+default value=3 %d
+invalid,__expiry__=soon value=4 %d`, ts, ts, ts, ts))
+
+	expected := `
+# HELP default InfluxDB Metric
+# TYPE default untyped
+default 3
+# HELP invalid InfluxDB Metric
+# TYPE invalid untyped
+invalid 4
+# HELP slow InfluxDB Metric
+# TYPE slow untyped
+slow 2
+`
+	compare(t, c, expected, "fast", "slow", "default", "invalid")
+
+	// The garbage collection honors the expiry of each sample too.
+	c.gc(time.Now())
+	if n := len(c.Samples()); n != 3 {
+		t.Fatalf("expected 3 samples after garbage collection, got %d", n)
+	}
+	c.gc(time.Now().Add(10 * time.Minute))
+	if samples := c.Samples(); len(samples) != 1 || samples[0].Name != "slow" {
+		t.Fatalf("expected only the slow sample after 10 minutes, got %v", samples)
+	}
+}
+
+func TestInvalidExpiryTagLoggedOnce(t *testing.T) {
+	hook := logtest.NewHook()
+	c := newTestCollector(Config{ExpiryTag: "__expiry__"})
+	parse(t, c, "multi,__expiry__=later a=1,b=2,c=3,d=4")
+
+	if n := len(hook.Logged(`invalid expiry "later" for measurement multi`)); n != 1 {
+		t.Fatalf("expected the invalid expiry to be logged once, got %d times", n)
+	}
+	if n := len(c.Samples()); n != 4 {
+		t.Fatalf("expected 4 samples with the default expiry, got %d", n)
+	}
+}
+
+func TestLowercaseNames(t *testing.T) {
+	for _, tc := range []struct {
+		lowercase  bool
+		expected   []string
+		collisions float64
+	}{
+		{expected: []string{`DiskIO_Reads{Device="sda"}`, `diskio_reads{device="sda"}`}},
+		{lowercase: true, expected: []string{`diskio_reads{device="sda"}`}, collisions: 1},
+	} {
+		c := newTestCollector(Config{LowercaseNames: tc.lowercase})
+		parse(t, c, "DiskIO,Device=sda Reads=1\ndiskio,device=sda reads=2")
+
+		if got := series(c); fmt.Sprint(got) != fmt.Sprint(tc.expected) {
+			t.Fatalf("lowercase %t: expected %v, got %v", tc.lowercase, tc.expected, got)
+		}
+		if v := testutil.ToFloat64(c.lowercaseCollisions); v != tc.collisions {
+			t.Fatalf("lowercase %t: expected %v collisions, got %v", tc.lowercase, tc.collisions, v)
+		}
+	}
+}
+
+func TestUnsupportedFields(t *testing.T) {
+	c := newTestCollector(Config{})
+	parse(t, c, `log,host=a msg="started",code=1i`)
+
+	compare(t, c, `
+# HELP influxdb_exporter_unsupported_fields_total Total number of fields dropped because of an unsupported type.
+# TYPE influxdb_exporter_unsupported_fields_total counter
+influxdb_exporter_unsupported_fields_total{type="other"} 0
+influxdb_exporter_unsupported_fields_total{type="string"} 1
+`, "influxdb_exporter_unsupported_fields_total")
+	if got := series(c); fmt.Sprint(got) != `[log_code{host="a"}]` {
+		t.Fatalf("expected only the integer field, got %v", got)
+	}
+}
+
+func TestLabelPrecedence(t *testing.T) {
+	for _, tc := range []struct {
+		tagsPrecedence bool
+		expected       string
+	}{
+		{expected: `cpu{source="injected"}`},
+		{tagsPrecedence: true, expected: `cpu{source="tag"}`},
+	} {
+		c := newTestCollector(Config{TagsPrecedence: tc.tagsPrecedence})
+		points, err := models.ParsePoints([]byte("cpu,source=tag value=1"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.ParsePointsWithLabels(points, map[string]string{"source": "injected"})
+		drain(c)
+		if got := series(c); fmt.Sprint(got) != "["+tc.expected+"]" {
+			t.Fatalf("tags precedence %t: expected %s, got %v", tc.tagsPrecedence, tc.expected, got)
+		}
+	}
+}
+
+func TestOldestSampleAge(t *testing.T) {
+	c := newTestCollector(Config{SampleExpiry: time.Hour})
+	if age := c.oldestSampleAge(); age != 0 {
+		t.Fatalf("expected 0 without samples, got %v", age)
+	}
+	now := time.Now()
+	parse(t, c, fmt.Sprintf("cpu value=1 %d\nmem value=1 %d", now.Add(-10*time.Minute).UnixNano(), now.Add(-time.Minute).UnixNano()))
+
+	st := c.Stats()
+	if st.Series != 2 {
+		t.Fatalf("expected 2 series, got %d", st.Series)
+	}
+	// Allow for the time elapsed since now.
+	if d := st.OldestSampleAge - 10*time.Minute; d < 0 || d > time.Second {
+		t.Fatalf("expected the oldest sample to be 10m old, got %s", st.OldestSampleAge)
+	}
+	if d := st.NewestSampleAge - time.Minute; d < 0 || d > time.Second {
+		t.Fatalf("expected the newest sample to be 1m old, got %s", st.NewestSampleAge)
+	}
+}
+
+func TestParsePoints(t *testing.T) {
+	points, err := models.ParsePoints([]byte(`cpu,host=a,cpu=cpu0 usage_idle=97.5,usage_user=2i
+temperature,room=kitchen value=21.5
+door,room=kitchen open=true
+log,host=a msg="ignored"`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the exported API, without HTTP or UDP listener.
+	c := NewCollector(Config{SampleExpiry: time.Minute})
+	go func() {
+		c.ParsePoints(points)
+		c.Close()
+	}()
+	c.Run()
+
+	var got []string
+	for _, s := range c.Samples() {
+		got = append(got, fmt.Sprintf("%s %s.%s %v", s.Name, s.Measurement, s.Field, s.Value))
+	}
+	expected := []string{
+		"cpu_usage_idle cpu.usage_idle 97.5",
+		"cpu_usage_user cpu.usage_user 2",
+		"door_open door.open 1",
+		"temperature temperature.value 21.5",
+	}
+	if fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Fatalf("expected %q, got %q", expected, got)
+	}
+	if got := series(c); got[0] != `cpu_usage_idle{cpu="cpu0", host="a"}` {
+		t.Fatalf("expected the tags as labels, got %s", got[0])
+	}
+}
+
+func TestNameSeparator(t *testing.T) {
+	for _, tc := range []struct {
+		separator string
+		expected  string
+	}{
+		{expected: "[cpu_usage_idle]"},
+		{separator: "__", expected: "[cpu__usage_idle]"},
+		// Invalid characters are sanitized.
+		{separator: ".", expected: "[cpu_usage_idle]"},
+	} {
+		c := newTestCollector(Config{NameSeparator: tc.separator})
+		parse(t, c, "cpu usage_idle=1")
+		if got := series(c); fmt.Sprint(got) != tc.expected {
+			t.Fatalf("separator %q: expected %s, got %v", tc.separator, tc.expected, got)
+		}
+	}
+}
+
+func TestTypeOverrides(t *testing.T) {
+	c := newTestCollector(Config{
+		IntAsCounter: true,
+		TypeOverrides: map[FieldKey]prometheus.ValueType{
+			{"diskio", "reads"}:   prometheus.CounterValue,
+			{"diskio", "io_time"}: prometheus.GaugeValue,
+			{"diskio", "weight"}:  prometheus.UntypedValue,
+		},
+	})
+	parse(t, c, "diskio reads=1,io_time=2,weight=3i,writes=4")
+
+	compare(t, c, `
+# HELP diskio_io_time InfluxDB Metric
+# TYPE diskio_io_time gauge
+diskio_io_time 2
+# HELP diskio_reads InfluxDB Metric
+# TYPE diskio_reads counter
+diskio_reads 1
+# HELP diskio_weight InfluxDB Metric
+# TYPE diskio_weight untyped
+diskio_weight 3
+# HELP diskio_writes InfluxDB Metric
+# TYPE diskio_writes untyped
+diskio_writes 4
+`, "diskio_io_time", "diskio_reads", "diskio_weight", "diskio_writes")
+}
+
+func TestPointsAndSamplesTotal(t *testing.T) {
+	c := newTestCollector(Config{})
+	parse(t, c, `cpu usage_idle=1,usage_user=2,usage_system=3i,online=true,model="x"`)
+
+	compare(t, c, `
+# HELP influxdb_exporter_points_total Total number of points parsed.
+# TYPE influxdb_exporter_points_total counter
+influxdb_exporter_points_total 1
+# HELP influxdb_exporter_samples_total Total number of samples produced from the parsed points.
+# TYPE influxdb_exporter_samples_total counter
+influxdb_exporter_samples_total 4
+`, "influxdb_exporter_points_total", "influxdb_exporter_samples_total")
+}
+
+func TestTrimTagKey(t *testing.T) {
+	for _, tc := range []struct {
+		name           string
+		prefix, suffix string
+		expected       string
+	}{
+		{name: "none", expected: `[m_v{tag_="a", tag_host_ms="b", tag_rack="c"}]`},
+		{name: "prefix", prefix: "tag_", expected: `[m_v{host_ms="b", rack="c", tag_="a"}]`},
+		{name: "suffix", suffix: "_ms", expected: `[m_v{tag_="a", tag_host="b", tag_rack="c"}]`},
+		{name: "combined", prefix: "tag_", suffix: "_ms", expected: `[m_v{host="b", rack="c", tag_="a"}]`},
+		// Keys made only of the prefix and suffix are kept whole.
+		{name: "whole name", prefix: "tag", suffix: "_", expected: `[m_v{_host_ms="b", _rack="c", tag_="a"}]`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newTestCollector(Config{TagKeyTrimPrefix: tc.prefix, TagKeyTrimSuffix: tc.suffix})
+			parse(t, c, "m,tag_=a,tag_host_ms=b,tag_rack=c v=1")
+			if got := series(c); fmt.Sprint(got) != tc.expected {
+				t.Fatalf("expected %s, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestInstanceLabel(t *testing.T) {
+	c := newTestCollector(Config{KeepTags: []string{"host"}, InstanceLabelName: "exporter", InstanceLabelValue: "edge-1"})
+	points, err := models.ParsePoints([]byte("cpu,host=a,rack=r1 idle=1,user=2\nmem,exporter=other free=3\ndisk used=4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.ParsePointsWithLabels(points, map[string]string{"exporter": "injected", "source": "x"})
+	drain(c)
+
+	// The identity label overrides tags and injected labels and isn't
+	// subject to the allow-list.
+	expected := `[cpu_idle{exporter="edge-1", host="a", source="x"} cpu_user{exporter="edge-1", host="a", source="x"} disk_used{exporter="edge-1", source="x"} mem_free{exporter="edge-1", source="x"}]`
+	if got := series(c); fmt.Sprint(got) != expected {
+		t.Fatalf("expected %s, got %v", expected, got)
+	}
+}
+
+func TestCoerceNumericStrings(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		coerce      bool
+		lp          string
+		expected    string
+		unsupported float64
+	}{
+		{name: "coercible", coerce: true, lp: `sensor,host=a temp="42.5",id=1i`, expected: `[sensor_id{host="a"} 1 sensor_temp{host="a"} 42.5]`},
+		{name: "not coercible", coerce: true, lp: `sensor,host=a temp="n/a",id=1i`, expected: `[sensor_id{host="a"} 1]`, unsupported: 1},
+		{name: "not finite", coerce: true, lp: `sensor,host=a temp="NaN",min="-Infinity",max="Inf",id=1i`, expected: `[sensor_id{host="a"} 1]`, unsupported: 3},
+		{name: "disabled", lp: `sensor,host=a temp="42.5",id=1i`, expected: `[sensor_id{host="a"} 1]`, unsupported: 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newTestCollector(Config{CoerceNumericStrings: tc.coerce})
+			parse(t, c, tc.lp)
+
+			var got []string
+			for i, s := range series(c) {
+				got = append(got, fmt.Sprintf("%s %v", s, c.Samples()[i].Value))
+			}
+			if fmt.Sprint(got) != tc.expected {
+				t.Fatalf("expected %s, got %v", tc.expected, got)
+			}
+			if v := testutil.ToFloat64(c.unsupportedFields.WithLabelValues("string")); v != tc.unsupported {
+				t.Fatalf("expected %v unsupported string fields, got %v", tc.unsupported, v)
+			}
+		})
+	}
+}
+
+func TestFieldLabel(t *testing.T) {
+	for _, tc := range []struct {
+		fieldLabel string
+		expected   string
+	}{
+		{expected: `[cpu{host="a"} cpu_usage_idle{host="a"} cpu_usage_user{host="a"}]`},
+		// The value field isn't exported as a label.
+		{fieldLabel: "field", expected: `[cpu{field="usage_idle", host="a"} cpu{field="usage_user", host="a"} cpu{host="a"}]`},
+	} {
+		c := newTestCollector(Config{FieldLabel: tc.fieldLabel})
+		parse(t, c, "cpu,host=a usage_idle=97.5,usage_user=2.5,value=100")
+		if got := series(c); fmt.Sprint(got) != tc.expected {
+			t.Fatalf("field label %q: expected %s, got %v", tc.fieldLabel, tc.expected, got)
+		}
+	}
+
+	c := newTestCollector(Config{FieldLabel: "field"})
+	parse(t, c, "cpu,host=a usage_idle=97.5,usage_user=2.5")
+	compare(t, c, `
+# HELP cpu InfluxDB Metric
+# TYPE cpu untyped
+cpu{field="usage_idle",host="a"} 97.5
+cpu{field="usage_user",host="a"} 2.5
+`, "cpu")
+}
+
+func TestPrecisionLoss(t *testing.T) {
+	for _, tc := range []struct {
+		dropImprecise bool
+		expected      string
+	}{
+		{expected: "[big exact negative]"},
+		{dropImprecise: true, expected: "[exact]"},
+	} {
+		c := newTestCollector(Config{DropImprecise: tc.dropImprecise})
+		// 2^53 and beyond may lose precision, 2^53-1 doesn't.
+		parse(t, c, "exact value=9007199254740991i\nbig value=9007199254740993i\nnegative value=-9007199254740992i")
+		if got := series(c); fmt.Sprint(got) != tc.expected {
+			t.Fatalf("drop imprecise %t: expected %s, got %v", tc.dropImprecise, tc.expected, got)
+		}
+		if v := testutil.ToFloat64(c.precisionLoss); v != 2 {
+			t.Fatalf("drop imprecise %t: expected 2 imprecise fields, got %v", tc.dropImprecise, v)
+		}
+	}
+}
+
+func TestSingleFieldBareName(t *testing.T) {
+	for _, tc := range []struct {
+		bare     bool
+		expected string
+	}{
+		{expected: `[cpu_usage_idle{host="a"} cpu_usage_user{host="a"} ping_average_response_ms{host="a"} status_up]`},
+		{bare: true, expected: `[cpu_usage_idle{host="a"} cpu_usage_user{host="a"} ping{host="a"} status]`},
+	} {
+		c := newTestCollector(Config{SingleFieldBareName: tc.bare})
+		// Only numeric fields are counted.
+		parse(t, c, "ping,host=a average_response_ms=12.5\ncpu,host=a usage_idle=97.5,usage_user=2.5\nstatus up=true,msg=\"ok\"")
+		if got := series(c); fmt.Sprint(got) != tc.expected {
+			t.Fatalf("bare name %t: expected %s, got %v", tc.bare, tc.expected, got)
+		}
+	}
+}
+
+func TestKeepFields(t *testing.T) {
+	c := newTestCollector(Config{KeepFields: []FieldKey{{"cpu", "usage_idle"}, {"cpu", "usage_system"}}})
+	parse(t, c, "cpu,host=a usage_idle=97.5,usage_user=1.5,usage_system=1,usage_nice=0\nmem,host=a free=3,used=5")
+
+	expected := `[cpu_usage_idle{host="a"} cpu_usage_system{host="a"} mem_free{host="a"} mem_used{host="a"}]`
+	if got := series(c); fmt.Sprint(got) != expected {
+		t.Fatalf("expected %s, got %v", expected, got)
+	}
+	if v := testutil.ToFloat64(c.droppedFields); v != 2 {
+		t.Fatalf("expected 2 dropped fields, got %v", v)
+	}
+}
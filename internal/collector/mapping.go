@@ -0,0 +1,153 @@
+// Copyright 2016 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+
+	"github.com/influxdata/influxdb/models"
+	"github.com/prometheus/client_golang/prometheus"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// MappingConfig is an ordered list of rules rewriting the metrics produced
+// from points.
+type MappingConfig struct {
+	Mappings []*MappingRule `yaml:"mappings"`
+}
+
+// MappingRule rewrites the metrics of the points whose measurement and tags
+// match.
+type MappingRule struct {
+	// Match is the pattern matched against the measurement.
+	Match string `yaml:"match"`
+	// MatchType is either "glob" (default) or "regex".
+	MatchType string `yaml:"match_type"`
+	// Tags are patterns matched against the tag values, all tags must be
+	// present and match.
+	Tags map[string]string `yaml:"tags"`
+	// Name replaces the measurement in the metric name. It can reference
+	// the groups captured by Match with $1, $2 and so on, a glob capturing
+	// a group for each *.
+	Name string `yaml:"name"`
+	// Labels renames tags, the keys being the tag names and the values the
+	// label names.
+	Labels map[string]string `yaml:"labels"`
+	// Type is the metric type, either "counter", "gauge" or "untyped".
+	Type string `yaml:"type"`
+
+	match     *regexp.Regexp
+	tags      map[string]*regexp.Regexp
+	valueType prometheus.ValueType
+}
+
+// LoadMappingConfig reads and validates a mapping configuration file.
+func LoadMappingConfig(filename string) (*MappingConfig, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &MappingConfig{}
+	if err := yaml.UnmarshalStrict(content, cfg); err != nil {
+		return nil, err
+	}
+	for i, r := range cfg.Mappings {
+		if err := r.init(); err != nil {
+			return nil, fmt.Errorf("invalid mapping %d: %s", i, err)
+		}
+	}
+	return cfg, nil
+}
+
+func (r *MappingRule) init() error {
+	var err error
+	if r.match, err = compilePattern(r.Match, r.MatchType); err != nil {
+		return err
+	}
+	r.tags = make(map[string]*regexp.Regexp, len(r.Tags))
+	for k, v := range r.Tags {
+		if r.tags[k], err = compilePattern(v, r.MatchType); err != nil {
+			return err
+		}
+	}
+	if r.Type == "" {
+		r.valueType = prometheus.UntypedValue
+		return nil
+	}
+	r.valueType, err = ParseValueType(r.Type)
+	return err
+}
+
+// ParseValueType returns the value type for "counter", "gauge" or "untyped".
+func ParseValueType(s string) (prometheus.ValueType, error) {
+	switch s {
+	case "counter":
+		return prometheus.CounterValue, nil
+	case "gauge":
+		return prometheus.GaugeValue, nil
+	case "untyped":
+		return prometheus.UntypedValue, nil
+	}
+	return 0, fmt.Errorf("unknown metric type %q", s)
+}
+
+// compilePattern returns an anchored regular expression for the pattern.
+func compilePattern(pattern, matchType string) (*regexp.Regexp, error) {
+	switch matchType {
+	case "glob", "":
+		pattern = strings.Replace(regexp.QuoteMeta(pattern), `\*`, "(.*)", -1)
+	case "regex":
+	default:
+		return nil, fmt.Errorf("unknown match type %q", matchType)
+	}
+	return regexp.Compile("^(?:" + pattern + ")$")
+}
+
+// label returns the label name the tag is renamed to, if any. It is nil-safe.
+func (r *MappingRule) label(tag string) (string, bool) {
+	if r == nil {
+		return "", false
+	}
+	l, ok := r.Labels[tag]
+	return l, ok
+}
+
+// match returns the first rule matching the measurement and tags along with
+// the rewritten measurement. It returns a nil rule if none matches.
+func (m *MappingConfig) match(measurement string, tags models.Tags) (*MappingRule, string) {
+	if m == nil {
+		return nil, measurement
+	}
+rules:
+	for _, r := range m.Mappings {
+		idx := r.match.FindStringSubmatchIndex(measurement)
+		if idx == nil {
+			continue
+		}
+		for k, re := range r.tags {
+			v := tags.Get([]byte(k))
+			if v == nil || !re.Match(v) {
+				continue rules
+			}
+		}
+		if r.Name == "" {
+			return r, measurement
+		}
+		return r, string(r.match.ExpandString(nil, r.Name, measurement, idx))
+	}
+	return nil, measurement
+}
@@ -0,0 +1,90 @@
+// Copyright 2016 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// loadMapping loads the mapping configuration from a temporary file.
+func loadMapping(t *testing.T, config string) (*MappingConfig, error) {
+	t.Helper()
+	f, err := ioutil.TempFile("", "mapping")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(config); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return LoadMappingConfig(f.Name())
+}
+
+func TestMapping(t *testing.T) {
+	m, err := loadMapping(t, `
+mappings:
+- match: "disk*"
+  tags:
+    host: "web*"
+  name: "node_disk$1"
+  labels:
+    host: instance
+  type: counter
+- match: 'cpu_(\w+)'
+  match_type: regex
+  name: "node_cpu_${1}"
+  type: gauge
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newTestCollector(Config{Mapping: m})
+	parse(t, c, `diskio,host=web1 reads=3i
+diskio,host=db1 writes=4i
+cpu_total usage=5
+mem free=6`)
+
+	compare(t, c, `
+# HELP diskio_writes InfluxDB Metric
+# TYPE diskio_writes untyped
+diskio_writes{host="db1"} 4
+# HELP mem_free InfluxDB Metric
+# TYPE mem_free untyped
+mem_free 6
+# HELP node_cpu_total_usage InfluxDB Metric
+# TYPE node_cpu_total_usage gauge
+node_cpu_total_usage 5
+# HELP node_diskio_reads InfluxDB Metric
+# TYPE node_diskio_reads counter
+node_diskio_reads{instance="web1"} 3
+`, "diskio_writes", "mem_free", "node_cpu_total_usage", "node_diskio_reads")
+}
+
+func TestMappingInvalid(t *testing.T) {
+	for _, config := range []string{
+		"mappings:\n- match: cpu\n  type: histogram\n",
+		"mappings:\n- match: '('\n  match_type: regex\n",
+		"mappings:\n- match: cpu\n  match_type: exact\n",
+		"mappings:\n- match: cpu\n  unknown: field\n",
+	} {
+		if _, err := loadMapping(t, config); err == nil {
+			t.Fatalf("expected an error for %q", config)
+		}
+	}
+}
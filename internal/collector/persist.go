@@ -0,0 +1,97 @@
+// Copyright 2016 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// savedSample is a sample as saved to PersistPath. The value is a string as
+// JSON has no representation of NaN and infinities.
+type savedSample struct {
+	*Sample
+	Value string
+}
+
+// load reads the samples saved to PersistPath, skipping the stale ones. A
+// missing file isn't an error.
+func (c *Collector) load() error {
+	content, err := ioutil.ReadFile(c.cfg.PersistPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var saved []savedSample
+	if err := json.Unmarshal(content, &saved); err != nil {
+		return err
+	}
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, ss := range saved {
+		s := ss.Sample
+		if s == nil {
+			continue
+		}
+		if s.Value, err = strconv.ParseFloat(ss.Value, 64); err != nil {
+			return err
+		}
+		if !c.stale(s, now) && c.recordNameType(s.Name, s.Type) {
+			c.samples[s.ID] = s
+		}
+	}
+	return nil
+}
+
+// save writes the stored samples to PersistPath. The file is replaced
+// atomically so that a crash while saving keeps the previous samples.
+func (c *Collector) save() error {
+	c.mu.Lock()
+	samples := c.sortedSamples()
+	saved := make([]savedSample, 0, len(samples))
+	for _, s := range samples {
+		saved = append(saved, savedSample{Sample: s, Value: strconv.FormatFloat(s.Value, 'g', -1, 64)})
+	}
+	content, err := json.Marshal(saved)
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(c.cfg.PersistPath), filepath.Base(c.cfg.PersistPath)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), c.cfg.PersistPath)
+}
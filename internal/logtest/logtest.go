@@ -0,0 +1,58 @@
+// Copyright 2016 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package logtest records the messages logged by the tests.
+package logtest
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/prometheus/common/log"
+	"github.com/sirupsen/logrus"
+)
+
+// Hook records the logged messages.
+type Hook struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+// NewHook returns a hook recording the messages logged from now on.
+func NewHook() *Hook {
+	h := &Hook{}
+	log.AddHook(h)
+	return h
+}
+
+func (h *Hook) Levels() []logrus.Level { return logrus.AllLevels }
+
+func (h *Hook) Fire(e *logrus.Entry) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.messages = append(h.messages, e.Message)
+	return nil
+}
+
+// Logged returns the recorded messages starting with the prefix.
+func (h *Hook) Logged(prefix string) []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var messages []string
+	for _, m := range h.messages {
+		if strings.HasPrefix(m, prefix) {
+			messages = append(messages, m)
+		}
+	}
+	return messages
+}
@@ -0,0 +1,93 @@
+// Copyright 2016 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/influxdata/influxdb/models"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+	"github.com/segmentio/kafka-go"
+)
+
+var (
+	kafkaConsumed = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "influxdb_kafka_consumed_total",
+			Help: "Total number of Kafka messages consumed.",
+		},
+	)
+	kafkaParseErrors = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "influxdb_kafka_parse_errors_total",
+			Help: "Total number of Kafka messages that couldn't be parsed as line protocol.",
+		},
+	)
+)
+
+// Bounds of the delay before fetching a Kafka message again after an error.
+var (
+	kafkaMinBackoff = 100 * time.Millisecond
+	kafkaMaxBackoff = 30 * time.Second
+)
+
+// kafkaConsumer is the part of kafka.Reader used by consumeKafka.
+type kafkaConsumer interface {
+	FetchMessage(ctx context.Context) (kafka.Message, error)
+	CommitMessages(ctx context.Context, msgs ...kafka.Message) error
+}
+
+// consumeKafka feeds the line protocol messages read by r to the collector
+// until r is closed or ctx is canceled. The offsets are committed once the
+// messages are parsed. Other errors are retried with an exponential backoff.
+func (s *server) consumeKafka(ctx context.Context, r kafkaConsumer) {
+	backoff := kafkaMinBackoff
+	for {
+		m, err := r.FetchMessage(ctx)
+		if err == io.EOF || ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Errorf("Failed to read Kafka message, retrying in %s: %s", backoff, err)
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return
+			}
+			if backoff *= 2; backoff > kafkaMaxBackoff {
+				backoff = kafkaMaxBackoff
+			}
+			continue
+		}
+		backoff = kafkaMinBackoff
+		kafkaConsumed.Inc()
+
+		points, err := models.ParsePointsWithPrecision(m.Value, time.Now().UTC(), *defaultPrecision)
+		if err != nil {
+			log.Errorf("Error parsing Kafka message at offset %d of partition %d: %s", m.Offset, m.Partition, err)
+			kafkaParseErrors.Inc()
+		} else {
+			s.recordPush(points, "kafka")
+			s.collector.ParsePoints(points)
+		}
+
+		// Invalid messages are committed too, they would fail again.
+		if err := r.CommitMessages(ctx, m); err != nil {
+			log.Errorf("Failed to commit Kafka message at offset %d of partition %d: %s", m.Offset, m.Partition, err)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright 2016 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// fakeConsumer returns its results in order, then io.EOF.
+type fakeConsumer struct {
+	results   []fakeResult
+	committed []kafka.Message
+}
+
+type fakeResult struct {
+	msg kafka.Message
+	err error
+}
+
+func (f *fakeConsumer) FetchMessage(ctx context.Context) (kafka.Message, error) {
+	if len(f.results) == 0 {
+		return kafka.Message{}, io.EOF
+	}
+	r := f.results[0]
+	f.results = f.results[1:]
+	return r.msg, r.err
+}
+
+func (f *fakeConsumer) CommitMessages(ctx context.Context, msgs ...kafka.Message) error {
+	f.committed = append(f.committed, msgs...)
+	return nil
+}
+
+func TestConsumeKafka(t *testing.T) {
+	defer func(min time.Duration) { kafkaMinBackoff = min }(kafkaMinBackoff)
+	kafkaMinBackoff = time.Millisecond
+
+	s, samples := newTestServer(t)
+	r := &fakeConsumer{results: []fakeResult{
+		{msg: kafka.Message{Offset: 1, Value: []byte("cpu value=1")}},
+		{err: errors.New("connection reset")},
+		{err: errors.New("connection reset")},
+		{msg: kafka.Message{Offset: 2, Value: []byte("invalid")}},
+		{msg: kafka.Message{Offset: 3, Value: []byte("mem value=2")}},
+	}}
+	s.consumeKafka(context.Background(), r)
+
+	if len(r.committed) != 3 {
+		t.Fatalf("expected 3 committed messages, got %d", len(r.committed))
+	}
+	got := samples()
+	if len(got) != 2 || got[0].Name != "cpu" || got[1].Name != "mem" {
+		t.Fatalf("expected the cpu and mem samples, got %v", got)
+	}
+}
+
+func TestConsumeKafkaCanceled(t *testing.T) {
+	s, _ := newTestServer(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	done := make(chan struct{})
+	go func() {
+		s.consumeKafka(ctx, &fakeConsumer{results: []fakeResult{{err: context.Canceled}}})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("consumer not stopped by the canceled context")
+	}
+}
@@ -14,292 +14,969 @@
 package main
 
 import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"html/template"
+	"io"
 	"io/ioutil"
+	"mime"
 	"net"
 	"net/http"
 	"os"
-	"regexp"
-	"sort"
-	"sync"
+	"os/signal"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	"github.com/coreos/go-systemd/v22/activation"
 	"gopkg.in/alecthomas/kingpin.v2"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
 	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
 	"github.com/prometheus/common/version"
 
 	"github.com/influxdata/influxdb/models"
+
+	"golang.org/x/time/rate"
+
+	"github.com/prometheus/influxdb_exporter/internal/collector"
+	"github.com/segmentio/kafka-go"
 )
 
 const (
-	MAX_UDP_PAYLOAD = 64 * 1024
+	// udpQueueSize is the number of datagrams read but not parsed yet.
+	udpQueueSize = 1000
 )
 
+// precisions lists the timestamp precisions supported by the line protocol parser.
+var precisions = []string{"ns", "u", "ms", "s", "m", "h"}
+
+// landingPage is the page served on / unless --web.disable-landing-page is set.
+var landingPage = template.Must(template.New("landing").Parse(`<html>
+    <head><title>InfluxDB Exporter</title></head>
+    <body>
+    <h1>InfluxDB Exporter</h1>
+    <p><a href="{{ .MetricsPath }}">Metrics</a></p>
+    </body>
+    </html>`))
+
 var (
-	listenAddress   = kingpin.Flag("web.listen-address", "Address on which to expose metrics and web interface.").Default(":9122").String()
-	metricsPath     = kingpin.Flag("web.telemetry-path", "Path under which to expose Prometheus metrics.").Default("/metrics").String()
-	sampleExpiry    = kingpin.Flag("influxdb.sample-expiry", "How long a sample is valid for.").Default("5m").Duration()
-	bindAddress     = kingpin.Flag("udp.bind-address", "Address on which to listen for udp packets.").Default(":9122").String()
-	exportTimestamp = kingpin.Flag("timestamps", "Export timestamps of points").Default("false").Bool()
-	lastPush        = prometheus.NewGauge(
+	listenAddress       = kingpin.Flag("web.listen-address", "Address on which to expose metrics and web interface.").Default(":9122").String()
+	metricsPath         = kingpin.Flag("web.telemetry-path", "Path under which to expose Prometheus metrics.").Default("/metrics").String()
+	systemdSocket       = kingpin.Flag("web.systemd-socket", "Use the sockets passed by systemd socket activation: the stream socket for HTTP and, if present, the datagram socket for UDP instead of --udp.bind-address.").Default("false").Bool()
+	readHeaderTimeout   = kingpin.Flag("web.read-header-timeout", "Maximum duration for reading the headers of a request.").Default("10s").Duration()
+	readTimeout         = kingpin.Flag("web.read-timeout", "Maximum duration for reading an entire request, including the body.").Default("1m").Duration()
+	writeTimeout        = kingpin.Flag("web.write-timeout", "Maximum duration before timing out the writes of a response.").Default("1m").Duration()
+	disableLandingPage  = kingpin.Flag("web.disable-landing-page", "Return 404 on / instead of the landing page.").Default("false").Bool()
+	sampleExpiry        = kingpin.Flag("influxdb.sample-expiry", "How long a sample is valid for. 0s exports samples once then drops them.").Default("5m").Duration()
+	bindAddress         = kingpin.Flag("udp.bind-address", "Address on which to listen for udp packets.").Default(":9122").String()
+	exportTimestamp     = kingpin.Flag("timestamps", "Export timestamps of points").Default("false").Bool()
+	keepTags            = kingpin.Flag("influxdb.keep-tags", "Tag to keep as a label, all other tags are dropped. Can be repeated. If unset, all tags are kept.").Strings()
+	sourceIPLabel       = kingpin.Flag("influxdb.source-ip-label", "Name of a label holding the IP address of the sender, added to every sample. Note that this increases the number of series exported. Disabled if empty.").Default("").String()
+	tagKeyTrimPrefix    = kingpin.Flag("influxdb.tag-key-trim-prefix", "Prefix removed from the tag keys before converting them to label names. A key that would be left empty by trimming is kept whole. Tags renamed by a mapping rule are left untouched.").Default("").String()
+	tagKeyTrimSuffix    = kingpin.Flag("influxdb.tag-key-trim-suffix", "Suffix removed from the tag keys before converting them to label names. A key that would be left empty by trimming is kept whole. Tags renamed by a mapping rule are left untouched.").Default("").String()
+	expiryTag           = kingpin.Flag("influxdb.expiry-tag", "Tag whose value, a duration, overrides the sample expiry for the point. The tag is not exported as a label.").Default("__expiry__").String()
+	defaultPrecision    = kingpin.Flag("influxdb.default-precision", "Precision of the timestamps of HTTP writes without a precision parameter, of Kafka messages and of --oneshot input.").Default("ns").Enum(precisions...)
+	lowercaseNames      = kingpin.Flag("influxdb.lowercase-names", "Convert metric names and label names to lower case.").Default("false").Bool()
+	instanceLabel       = kingpin.Flag("influxdb.instance-label", "Label identifying this exporter added to every sample, in the name=value form. It overrides tags and injected labels with the same name. Disabled if empty.").Default("").String()
+	rpLabel             = kingpin.Flag("influxdb.rp-label", "Name of a label holding the retention policy of HTTP writes. Disabled if empty.").Default("").String()
+	labelPrecedence     = kingpin.Flag("influxdb.label-precedence", "Which value wins when a point tag and an injected label (source IP, retention policy) have the same name: \"tags\" or \"injected\".").Default("injected").Enum("tags", "injected")
+	channelBuffer       = kingpin.Flag("influxdb.channel-buffer", "Number of samples that can be queued before writers block.").Default("1000").Int()
+	persistPath         = kingpin.Flag("influxdb.persist-path", "File where the samples are saved every minute and restored from at startup, so that they survive restarts. Disabled if empty.").Default("").String()
+	dropOnFull          = kingpin.Flag("influxdb.drop-on-full", "Drop the samples instead of blocking the writers when the channel buffer is full.").Default("false").Bool()
+	udpRateLimit        = kingpin.Flag("udp.rate-limit", "Maximum number of UDP packets processed per second, 0 means unlimited.").Default("0").Float64()
+	udpOverflow         = kingpin.Flag("udp.overflow", "What happens to UDP packets when the parse queue is full: \"drop\" discards them to keep draining the socket, \"block\" waits at the risk of the socket buffer overflowing.").Default("drop").Enum("block", "drop")
+	udpPrecision        = kingpin.Flag("udp.precision", "Precision of the timestamps of UDP packets.").Default("ns").Enum(precisions...)
+	udpMaxPayload       = kingpin.Flag("udp.max-payload-size", "Maximum size of a UDP packet, larger packets are dropped.").Default("64KiB").Bytes()
+	udpIdleWarn         = kingpin.Flag("udp.idle-warn", "Log a warning when no UDP packet has been received for this duration, 0 disables the warning.").Default("0s").Duration()
+	mappingConfig       = kingpin.Flag("influxdb.mapping-config", "YAML file with the rules rewriting metric names, labels and types.").Default("").String()
+	bareName            = kingpin.Flag("influxdb.single-field-bare-name", "Name the metric of the points with a single numeric field after the measurement only.").Default("false").Bool()
+	fieldAsLabel        = kingpin.Flag("influxdb.field-as-label", "Name the metrics after the measurement only and export the field as a label, except for the \"value\" field.").Default("false").Bool()
+	fieldLabel          = kingpin.Flag("influxdb.field-label", "Name of the label holding the field with --influxdb.field-as-label.").Default("field").String()
+	nameSeparator       = kingpin.Flag("influxdb.name-separator", "Separator between the measurement and the field in metric names. Invalid characters for metric names are replaced by \"_\".").Default("_").String()
+	maxCollectSeries    = kingpin.Flag("influxdb.max-collect-series", "Maximum number of series exported per scrape, 0 means unlimited.").Default("0").Int()
+	slowWriteThreshold  = kingpin.Flag("influxdb.slow-write-threshold", "Log at debug level the size and the read, parse and store durations of the HTTP writes taking longer than this. Disabled if 0.").Default("0s").Duration()
+	maxLineSize         = kingpin.Flag("influxdb.max-line-size", "Maximum size of a line protocol line in HTTP writes.").Default("1MiB").Bytes()
+	detectHistograms    = kingpin.Flag("influxdb.detect-histograms", "Export the <name>_bucket fields with a le tag along with the <name>_sum and <name>_count fields of the same series as histograms, like the ones of the Telegraf histogram aggregator.").Default("false").Bool()
+	detectSummaries     = kingpin.Flag("influxdb.detect-summaries", "Export the <name> fields with a quantile tag along with the <name>_sum and <name>_count fields of the same series as summaries.").Default("false").Bool()
+	maxLabels           = kingpin.Flag("influxdb.max-labels", "Maximum number of labels of a series, not counting the instance label. Unlimited if 0.").Default("0").Int()
+	maxLabelsMode       = kingpin.Flag("influxdb.max-labels-mode", "What happens to series with too many labels: \"drop\" drops them and \"truncate\" keeps the first tags in alphabetical order along with the field and injected labels.").Default(collector.MaxLabelsDrop).Enum(collector.MaxLabelsDrop, collector.MaxLabelsTruncate)
+	dedupMode           = kingpin.Flag("influxdb.dedup-mode", "How a sample of an already stored series is handled: \"last-write\" replaces it, \"latest-timestamp\" replaces it if more recent, \"max\" keeps the highest value and \"sum\" adds the values.").Default(collector.DedupLastWrite).Enum(collector.DedupLastWrite, collector.DedupLatestTimestamp, collector.DedupMax, collector.DedupSum)
+	minRetention        = kingpin.Flag("influxdb.min-retention", "Keep expired samples until they have been scraped once after their expiry.").Default("false").Bool()
+	lastPushBy          = kingpin.Flag("influxdb.last-push-by", "Label the last push timestamp by \"measurement\" or by \"source\" IP address, \"off\" exports a single timestamp. Labelling increases the number of series exported.").Default("off").Enum("off", "measurement", "source")
+	coerceStrings       = kingpin.Flag("influxdb.coerce-numeric-strings", "Export string fields holding a finite number, like \"42.5\", instead of dropping them. NaN and infinities are dropped.").Default("false").Bool()
+	dropImprecise       = kingpin.Flag("influxdb.drop-imprecise", "Drop the integer fields whose magnitude, 2^53 or more, is too large to be converted to a float without losing precision.").Default("false").Bool()
+	intAsCounter        = kingpin.Flag("influxdb.int-as-counter", "Export integer fields as counters instead of untyped metrics. The type of mapping rules takes precedence.").Default("false").Bool()
+	oneshot             = kingpin.Flag("oneshot", "Read line protocol from stdin, print the metrics in the Prometheus exposition format to stdout and exit.").Default("false").Bool()
+	keepFields          = kingpin.Flag("influxdb.keep-fields", "Field to keep, in the form measurement.field. The other fields of the measurement are dropped, measurements without any kept field are untouched. Can be repeated.").Strings()
+	typeOverrides       = kingpin.Flag("influxdb.type-override", "Metric type of a field, in the form measurement.field=counter|gauge|untyped. Takes precedence over other type settings. Can be repeated.").Strings()
+	readyAfterFirstPush = kingpin.Flag("web.ready-after-first-push", "Report the exporter as not ready on /-/ready until data has been received.").Default("false").Bool()
+	skipIdentical       = kingpin.Flag("influxdb.skip-identical", "Ignore samples with the same value as the stored sample of the series. The stored sample keeps its timestamp so it expires even if the value is still pushed.").Default("false").Bool()
+	udpNetwork          = kingpin.Flag("udp.network", "Network of the UDP listener: \"udp\" for both IPv4 and IPv6, \"udp4\" or \"udp6\".").Default("udp").Enum("udp", "udp4", "udp6")
+	exemplarTag         = kingpin.Flag("influxdb.exemplar-tag", "Tag whose value is attached as an exemplar to counters named <name>_total instead of being exported as a label. Exemplars are only exposed in the OpenMetrics format. Disabled if empty.").Default("").String()
+	queryDatabase       = kingpin.Flag("influxdb.query-database", "Database name returned to SHOW DATABASES queries.").Default("prometheus").String()
+	kafkaBrokers        = kingpin.Flag("kafka.brokers", "Kafka broker to consume line protocol from, along with --kafka.topic. Can be repeated.").Strings()
+	kafkaTopic          = kingpin.Flag("kafka.topic", "Kafka topic whose messages are line protocol batches.").Default("").String()
+	kafkaGroupID        = kingpin.Flag("kafka.group-id", "Kafka consumer group committing the offsets of the consumed messages.").Default("influxdb_exporter").String()
+	kafkaCommitInterval = kingpin.Flag("kafka.commit-interval", "Interval at which the offsets are committed, 0 to commit every message synchronously.").Default("1s").Duration()
+	checkCmd            = kingpin.Command("check", "Print the metrics produced by a line protocol file and exit.")
+	checkFile           = checkCmd.Arg("file", "Line protocol file to check.").Required().ExistingFile()
+	checkPrecision      = checkCmd.Flag("precision", "Precision of the timestamps in the file.").Default("ns").Enum(precisions...)
+	serveCmd            = kingpin.Command("serve", "Run the exporter.").Default()
+	lastPush            = prometheus.NewGauge(
 		prometheus.GaugeOpts{
 			Name: "influxdb_last_push_timestamp_seconds",
 			Help: "Unix timestamp of the last received influxdb metrics push in seconds.",
 		},
 	)
+	lastPushVec = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "influxdb_last_push_timestamp_seconds",
+			Help: "Unix timestamp of the last received influxdb metrics push in seconds.",
+		},
+		[]string{"source"},
+	)
 	udpParseErrors = prometheus.NewCounter(
 		prometheus.CounterOpts{
 			Name: "influxdb_udp_parse_errors_total",
 			Help: "Current total udp parse errors.",
 		},
 	)
-	invalidChars = regexp.MustCompile("[^a-zA-Z0-9_]")
+	udpRateLimited = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "influxdb_udp_rate_limited_total",
+			Help: "Total number of udp packets dropped by the rate limiter.",
+		},
+	)
+	httpParseErrors = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "influxdb_http_parse_errors_total",
+			Help: "Total number of lines of HTTP writes that couldn't be parsed.",
+		},
+	)
+	udpDropped = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "influxdb_udp_dropped_total",
+			Help: "Total number of udp packets dropped because the parse queue was full.",
+		},
+	)
+	udpTruncated = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "influxdb_udp_truncated_total",
+			Help: "Total number of udp packets dropped because they were larger than the maximum payload size.",
+		},
+	)
 )
 
-type influxDBSample struct {
-	ID        string
-	Name      string
-	Labels    map[string]string
-	Value     float64
-	Timestamp time.Time
-}
-
-func (c *influxDBCollector) serveUdp() {
-	buf := make([]byte, MAX_UDP_PAYLOAD)
+func (s *server) serveUdp() {
+	// One more byte to detect the packets larger than the maximum.
+	buf := make([]byte, int(*udpMaxPayload)+1)
+	var (
+		idle     *time.Timer
+		idleWarn = *udpIdleWarn
+	)
+	if idleWarn > 0 {
+		idle = time.AfterFunc(idleWarn, func() {
+			log.Warnf("No UDP packet received for %s", idleWarn)
+		})
+	}
 	for {
-		n, _, err := c.conn.ReadFromUDP(buf)
+		n, addr, err := s.conn.ReadFromUDP(buf)
 		if err != nil {
 			log.Warnf("Failed to read UDP message: %s", err)
 			continue
 		}
+		if idle != nil {
+			idle.Reset(idleWarn)
+		}
+		if n > int(*udpMaxPayload) {
+			log.Warnf("Dropping UDP packet from %s larger than %s", addr, *udpMaxPayload)
+			udpTruncated.Inc()
+			continue
+		}
+		if s.udpLimiter != nil && !s.udpLimiter.Allow() {
+			udpRateLimited.Inc()
+			continue
+		}
 
-		bufCopy := make([]byte, n)
-		copy(bufCopy, buf[:n])
+		p := udpPacket{
+			data:     make([]byte, n),
+			source:   addr.IP.String(),
+			received: time.Now().UTC(),
+		}
+		copy(p.data, buf[:n])
+		if *udpOverflow == "block" {
+			s.udpQueue <- p
+			continue
+		}
+		select {
+		case s.udpQueue <- p:
+		default:
+			udpDropped.Inc()
+		}
+	}
+}
 
-		precision := "ns"
-		points, err := models.ParsePointsWithPrecision(bufCopy, time.Now().UTC(), precision)
+// udpPacket is a datagram waiting to be parsed.
+type udpPacket struct {
+	data     []byte
+	source   string
+	received time.Time
+}
+
+// parseUdp parses the datagrams queued by serveUdp.
+func (s *server) parseUdp() {
+	for p := range s.udpQueue {
+		points, err := models.ParsePointsWithPrecision(p.data, p.received, *udpPrecision)
 		if err != nil {
 			log.Errorf("Error parsing udp packet: %s", err)
 			udpParseErrors.Inc()
-			return
+			continue
 		}
 
-		c.parsePointsToSample(points)
+		s.recordPush(points, p.source)
+		s.collector.ParsePointsWithLabels(points, sourceLabels(p.source))
 	}
 }
 
-type influxDBCollector struct {
-	samples map[string]*influxDBSample
-	mu      sync.Mutex
-	ch      chan *influxDBSample
+type server struct {
+	collector *collector.Collector
+	// pushed is set to 1 once points have been received. Accessed atomically.
+	pushed int32
 
 	// Udp
-	conn *net.UDPConn
+	conn       *net.UDPConn
+	udpLimiter *rate.Limiter
+	// udpQueue holds the datagrams read from conn until they are parsed.
+	udpQueue chan udpPacket
 }
 
-func newInfluxDBCollector() *influxDBCollector {
-	c := &influxDBCollector{
-		ch:      make(chan *influxDBSample),
-		samples: map[string]*influxDBSample{},
-	}
-	go c.processSamples()
-	return c
+// acceptedContentTypes lists the media types accepted for line protocol
+// payloads. Many clients don't set a content type at all and curl defaults to
+// application/x-www-form-urlencoded with --data-binary.
+var acceptedContentTypes = map[string]struct{}{
+	"text/plain":                        {},
+	"application/octet-stream":          {},
+	"application/x-www-form-urlencoded": {},
 }
 
-func (c *influxDBCollector) influxDBPost(w http.ResponseWriter, r *http.Request) {
-	lastPush.Set(float64(time.Now().UnixNano()) / 1e9)
-	buf, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("error reading body: %s", err), 500)
-		return
+// writePrecision returns the timestamp precision of a write request.
+func writePrecision(r *http.Request) string {
+	if p := r.URL.Query().Get("precision"); p != "" {
+		return p
 	}
+	return *defaultPrecision
+}
 
-	precision := "ns"
-	if r.FormValue("precision") != "" {
-		precision = r.FormValue("precision")
+// scanLines is a bufio.SplitFunc returning the lines of line protocol. Like
+// the InfluxDB parser, it doesn't split on the newlines of quoted field values.
+func scanLines(data []byte, atEOF bool) (int, []byte, error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
 	}
-	points, err := models.ParsePointsWithPrecision(buf, time.Now().UTC(), precision)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("error parsing request: %s", err), 400)
-		return
+	if i := lineEnd(data); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	if atEOF {
+		return len(data), data, nil
+	}
+	// Request more data.
+	return 0, nil, nil
+}
+
+// lineEnd returns the index of the newline ending the first line of buf, or
+// -1 if there is none. It follows the rules of the scanLine function of the
+// InfluxDB models package.
+func lineEnd(buf []byte) int {
+	var (
+		quoted, fields bool
+		// Field values are only quoted after an equal sign.
+		equals, commas int
+	)
+	for i := 0; i < len(buf); i++ {
+		switch {
+		case buf[i] == '\\':
+			// Skip the escaped character.
+			i++
+		case buf[i] == '\n' && !quoted:
+			return i
+		case !fields:
+			fields = buf[i] == ' '
+		case buf[i] == '=' && !quoted:
+			equals++
+		case buf[i] == ',' && !quoted:
+			commas++
+		case buf[i] == '"' && equals > commas:
+			quoted = !quoted
+		}
 	}
+	return -1
+}
 
-	c.parsePointsToSample(points)
+// writeError replies with an error in the JSON format used by InfluxDB.
+func writeError(w http.ResponseWriter, msg string, code int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Influxdb-Error", msg)
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(struct {
+		Error string `json:"error"`
+	}{msg})
+}
 
-	// InfluxDB returns a 204 on success.
-	http.Error(w, "", http.StatusNoContent)
+// queryResult is the result of a statement in the InfluxDB query API.
+type queryResult struct {
+	StatementID int           `json:"statement_id"`
+	Series      []querySeries `json:"series,omitempty"`
 }
 
-func (c *influxDBCollector) parsePointsToSample(points []models.Point) {
-	for _, s := range points {
-		fields, err := s.Fields()
-		if err != nil {
-			log.Errorf("error getting fields from point: %s", err)
+type querySeries struct {
+	Name    string          `json:"name"`
+	Columns []string        `json:"columns"`
+	Values  [][]interface{} `json:"values"`
+}
+
+// query answers the SHOW DATABASES and CREATE DATABASE statements that some
+// clients issue before writing. Other statements return an empty result.
+func query(w http.ResponseWriter, r *http.Request) {
+	results := []queryResult{}
+	for _, stmt := range strings.Split(r.FormValue("q"), ";") {
+		fields := strings.Fields(strings.ToUpper(stmt))
+		if len(fields) == 0 {
 			continue
 		}
-		for field, v := range fields {
-			var value float64
-			switch v := v.(type) {
-			case float64:
-				value = v
-			case int64:
-				value = float64(v)
-			case bool:
-				if v {
-					value = 1
-				} else {
-					value = 0
-				}
-			default:
-				continue
-			}
+		result := queryResult{StatementID: len(results)}
+		if len(fields) == 2 && fields[0] == "SHOW" && fields[1] == "DATABASES" {
+			result.Series = []querySeries{{
+				Name:    "databases",
+				Columns: []string{"name"},
+				Values:  [][]interface{}{{*queryDatabase}},
+			}}
+		}
+		results = append(results, result)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Results []queryResult `json:"results"`
+	}{results})
+}
 
-			var name string
-			if field == "value" {
-				name = string(s.Name())
-			} else {
-				name = fmt.Sprintf("%s_%s", s.Name(), field)
-			}
+func (s *server) influxDBPost(w http.ResponseWriter, r *http.Request) {
+	if ct := r.Header.Get("Content-Type"); ct != "" {
+		mediaType, _, err := mime.ParseMediaType(ct)
+		if _, ok := acceptedContentTypes[mediaType]; err != nil || !ok {
+			writeError(w, fmt.Sprintf("unsupported content type %q, expected line protocol as text/plain", ct), http.StatusUnsupportedMediaType)
+			return
+		}
+	}
 
-			sample := &influxDBSample{
-				Name:      invalidChars.ReplaceAllString(name, "_"),
-				Timestamp: s.Time(),
-				Value:     value,
-				Labels:    map[string]string{},
-			}
-			for _, v := range s.Tags() {
-				sample.Labels[invalidChars.ReplaceAllString(string(v.Key), "_")] = string(v.Value)
-			}
+	lastPush.Set(float64(time.Now().UnixNano()) / 1e9)
 
-			// Calculate a consistent unique ID for the sample.
-			labelnames := make([]string, 0, len(sample.Labels))
-			for k := range sample.Labels {
-				labelnames = append(labelnames, k)
-			}
-			sort.Strings(labelnames)
-			parts := make([]string, 0, len(sample.Labels)*2+1)
-			parts = append(parts, name)
-			for _, l := range labelnames {
-				parts = append(parts, l, sample.Labels[l])
+	var (
+		start                = time.Now()
+		size, npoints        int
+		parseTime, storeTime time.Duration
+	)
+	if *slowWriteThreshold > 0 {
+		defer func() {
+			total := time.Since(start)
+			if total < *slowWriteThreshold {
+				return
 			}
-			sample.ID = fmt.Sprintf("%q", parts)
+			log.Debugf("Slow write from %s: %d bytes, %d points in %s (read %s, parse %s, store %s)",
+				r.RemoteAddr, size, npoints, total, total-parseTime-storeTime, parseTime, storeTime)
+		}()
+	}
 
-			c.ch <- sample
+	body := r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			writeError(w, fmt.Sprintf("error reading gzip body: %s", err), 400)
+			return
 		}
+		defer gz.Close()
+		body = gz
 	}
-}
 
-func (c *influxDBCollector) processSamples() {
-	ticker := time.NewTicker(time.Minute).C
-	for {
-		select {
-		case s := <-c.ch:
-			c.mu.Lock()
-			c.samples[s.ID] = s
-			c.mu.Unlock()
-
-		case <-ticker:
-			// Garbage collect expired value lists.
-			ageLimit := time.Now().Add(-*sampleExpiry)
-			c.mu.Lock()
-			for k, sample := range c.samples {
-				if ageLimit.After(sample.Timestamp) {
-					delete(c.samples, k)
-				}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	labels := sourceLabels(host)
+	if rp := r.URL.Query().Get("rp"); *rpLabel != "" && rp != "" {
+		labels[*rpLabel] = rp
+	}
+
+	// Parse the body line by line to avoid buffering large batches. Like
+	// InfluxDB, valid points are kept even if other lines fail to parse.
+	// Quoted field values can span several lines.
+	var (
+		now       = time.Now().UTC()
+		precision = writePrecision(r)
+		parseErr  error
+	)
+	bufSize := 64 * 1024
+	if int(*maxLineSize) < bufSize {
+		bufSize = int(*maxLineSize)
+	}
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 0, bufSize), int(*maxLineSize))
+	scanner.Split(scanLines)
+	for scanner.Scan() {
+		size += len(scanner.Bytes()) + 1
+		t := time.Now()
+		points, err := models.ParsePointsWithPrecision(scanner.Bytes(), now, precision)
+		parseTime += time.Since(t)
+		if err != nil {
+			httpParseErrors.Inc()
+			if parseErr == nil {
+				parseErr = err
 			}
-			c.mu.Unlock()
+			continue
 		}
+		npoints += len(points)
+		t = time.Now()
+		s.recordPush(points, host)
+		s.collector.ParsePointsWithLabels(points, labels)
+		storeTime += time.Since(t)
+	}
+	if err := scanner.Err(); err != nil {
+		if err == bufio.ErrTooLong {
+			writeError(w, fmt.Sprintf("line longer than %s", *maxLineSize), http.StatusRequestEntityTooLarge)
+			return
+		}
+		writeError(w, fmt.Sprintf("error reading body: %s", err), 500)
+		return
+	}
+	if parseErr != nil {
+		writeError(w, fmt.Sprintf("error parsing request: %s", parseErr), 400)
+		return
+	}
+
+	// InfluxDB returns a 204 on success.
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ready replies with 503 until points have been received if
+// --web.ready-after-first-push is set, 200 otherwise.
+func (s *server) ready(w http.ResponseWriter, r *http.Request) {
+	if *readyAfterFirstPush && atomic.LoadInt32(&s.pushed) == 0 {
+		http.Error(w, "No data received yet.", http.StatusServiceUnavailable)
+		return
 	}
+	fmt.Fprintln(w, "Exporter is Ready.")
 }
 
-// Collect implements prometheus.Collector.
-func (c *influxDBCollector) Collect(ch chan<- prometheus.Metric) {
-	ch <- lastPush
+// status is the JSON document served on /api/v1/status.
+type status struct {
+	Series                 int     `json:"series"`
+	OldestSampleAgeSeconds float64 `json:"oldest_sample_age_seconds"`
+	NewestSampleAgeSeconds float64 `json:"newest_sample_age_seconds"`
+	HTTPParseErrors        float64 `json:"http_parse_errors"`
+	UDPParseErrors         float64 `json:"udp_parse_errors"`
+	UDPDropped             float64 `json:"udp_dropped"`
+	UDPRateLimited         float64 `json:"udp_rate_limited"`
+	HeapAllocBytes         uint64  `json:"heap_alloc_bytes"`
+	HeapInuseBytes         uint64  `json:"heap_inuse_bytes"`
+	HeapObjects            uint64  `json:"heap_objects"`
+}
 
-	c.mu.Lock()
-	samples := make([]*influxDBSample, 0, len(c.samples))
-	for _, sample := range c.samples {
-		samples = append(samples, sample)
+// counterValue returns the current value of the counter.
+func counterValue(c prometheus.Counter) float64 {
+	var m dto.Metric
+	if err := c.Write(&m); err != nil {
+		return 0
 	}
-	c.mu.Unlock()
+	return m.GetCounter().GetValue()
+}
 
-	ageLimit := time.Now().Add(-*sampleExpiry)
-	for _, sample := range samples {
-		if ageLimit.After(sample.Timestamp) {
-			continue
+// status serves a JSON summary of the stored samples and of the errors.
+func (s *server) status(w http.ResponseWriter, r *http.Request) {
+	st := s.collector.Stats()
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status{
+		Series:                 st.Series,
+		OldestSampleAgeSeconds: st.OldestSampleAge.Seconds(),
+		NewestSampleAgeSeconds: st.NewestSampleAge.Seconds(),
+		HTTPParseErrors:        counterValue(httpParseErrors),
+		UDPParseErrors:         counterValue(udpParseErrors),
+		UDPDropped:             counterValue(udpDropped),
+		UDPRateLimited:         counterValue(udpRateLimited),
+		HeapAllocBytes:         mem.HeapAlloc,
+		HeapInuseBytes:         mem.HeapInuse,
+		HeapObjects:            mem.HeapObjects,
+	})
+}
+
+// recordPush marks the exporter as having received data and updates the
+// labelled last push timestamps.
+func (s *server) recordPush(points []models.Point, source string) {
+	atomic.StoreInt32(&s.pushed, 1)
+
+	now := float64(time.Now().UnixNano()) / 1e9
+	switch *lastPushBy {
+	case "measurement":
+		for _, p := range points {
+			lastPushVec.WithLabelValues(string(p.Name())).Set(now)
 		}
+	case "source":
+		lastPushVec.WithLabelValues(source).Set(now)
+	}
+}
 
-		metric := prometheus.MustNewConstMetric(
-			prometheus.NewDesc(sample.Name, "InfluxDB Metric", []string{}, sample.Labels),
-			prometheus.UntypedValue,
-			sample.Value,
-		)
+// sourceLabels returns the labels identifying the sender of a batch of points.
+func sourceLabels(ip string) map[string]string {
+	labels := map[string]string{}
+	if *sourceIPLabel != "" {
+		labels[*sourceIPLabel] = ip
+	}
+	return labels
+}
 
-		if *exportTimestamp {
-			metric = prometheus.NewMetricWithTimestamp(sample.Timestamp, metric)
+// metricsHandler serves the metrics of the default registry or, with the
+// measurement parameter, only the samples of this measurement.
+func metricsHandler(c *collector.Collector) http.Handler {
+	opts := promhttp.HandlerOpts{EnableOpenMetrics: true}
+	all := promhttp.HandlerFor(prometheus.DefaultGatherer, opts)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		measurement := r.URL.Query().Get("measurement")
+		if measurement == "" {
+			all.ServeHTTP(w, r)
+			return
+		}
+		reg := prometheus.NewRegistry()
+		reg.MustRegister(c.Measurement(measurement))
+		promhttp.HandlerFor(reg, opts).ServeHTTP(w, r)
+	})
+}
+
+// convert returns a stopped collector holding the samples converted from the
+// line protocol read from r.
+func convert(r io.Reader, precision string, cfg collector.Config) (*collector.Collector, error) {
+	buf, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	points, err := models.ParsePointsWithPrecision(buf, time.Now().UTC(), precision)
+	if err != nil {
+		return nil, err
+	}
+
+	c := collector.NewCollector(cfg)
+	go func() {
+		c.ParsePoints(points)
+		c.Close()
+	}()
+	c.Run()
+	return c, nil
+}
+
+// runOneshot converts the line protocol read from r and writes the resulting
+// samples to w in the text exposition format, regardless of their age.
+func runOneshot(r io.Reader, w io.Writer, cfg collector.Config) error {
+	c, err := convert(r, *defaultPrecision, cfg)
+	if err != nil {
+		return err
+	}
+
+	reg := prometheus.NewRegistry()
+	if err := reg.Register(c.AllSamples()); err != nil {
+		return err
+	}
+	mfs, err := reg.Gather()
+	if err != nil {
+		return err
+	}
+	enc := expfmt.NewEncoder(w, expfmt.FmtText)
+	for _, mf := range mfs {
+		if err := enc.Encode(mf); err != nil {
+			return err
 		}
-		ch <- metric
 	}
+	return nil
 }
 
-// Describe implements prometheus.Collector.
-func (c *influxDBCollector) Describe(ch chan<- *prometheus.Desc) {
-	ch <- lastPush.Desc()
+// check parses a line protocol file and prints the resulting samples to w,
+// regardless of their age.
+func check(w io.Writer, path, precision string, cfg collector.Config) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	c, err := convert(f, precision, cfg)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range c.Samples() {
+		m := model.Metric{model.MetricNameLabel: model.LabelValue(s.Name)}
+		for k, v := range s.Labels {
+			m[model.LabelName(k)] = model.LabelValue(v)
+		}
+		fmt.Fprintf(w, "%s %v\n", m, s.Value)
+	}
+	return nil
+}
+
+// parseFieldKey parses a field of a measurement in the measurement.field form.
+// The measurement can contain dots but not the field.
+func parseFieldKey(s string) (collector.FieldKey, error) {
+	i := strings.LastIndex(s, ".")
+	if i <= 0 || i == len(s)-1 {
+		return collector.FieldKey{}, fmt.Errorf("invalid field %q, expected measurement.field", s)
+	}
+	return collector.FieldKey{Measurement: s[:i], Field: s[i+1:]}, nil
+}
+
+// collectorConfig returns the collector configuration from the command-line flags.
+func collectorConfig() (collector.Config, error) {
+	if *sampleExpiry < 0 {
+		return collector.Config{}, fmt.Errorf("invalid sample expiry %s, must not be negative", *sampleExpiry)
+	}
+	if *channelBuffer < 0 {
+		return collector.Config{}, fmt.Errorf("invalid channel buffer size %d, must not be negative", *channelBuffer)
+	}
+	if *maxLineSize <= 0 {
+		return collector.Config{}, fmt.Errorf("invalid max line size %s, must be positive", *maxLineSize)
+	}
+	if *udpMaxPayload <= 0 {
+		return collector.Config{}, fmt.Errorf("invalid UDP max payload size %s, must be positive", *udpMaxPayload)
+	}
+	for _, l := range []string{*sourceIPLabel, *rpLabel} {
+		if l != "" && !model.LabelName(l).IsValid() {
+			return collector.Config{}, fmt.Errorf("invalid label name %q", l)
+		}
+	}
+	var mapping *collector.MappingConfig
+	if *mappingConfig != "" {
+		var err error
+		mapping, err = collector.LoadMappingConfig(*mappingConfig)
+		if err != nil {
+			return collector.Config{}, fmt.Errorf("error loading mapping config %s: %s", *mappingConfig, err)
+		}
+	}
+	overrides := make(map[collector.FieldKey]prometheus.ValueType, len(*typeOverrides))
+	for _, o := range *typeOverrides {
+		i := strings.LastIndex(o, "=")
+		if i < 0 {
+			return collector.Config{}, fmt.Errorf("invalid type override %q, expected measurement.field=type", o)
+		}
+		key, err := parseFieldKey(o[:i])
+		if err != nil {
+			return collector.Config{}, err
+		}
+		t, err := collector.ParseValueType(o[i+1:])
+		if err != nil {
+			return collector.Config{}, fmt.Errorf("invalid type override %q: %s", o, err)
+		}
+		overrides[key] = t
+	}
+	kept := make([]collector.FieldKey, 0, len(*keepFields))
+	for _, f := range *keepFields {
+		key, err := parseFieldKey(f)
+		if err != nil {
+			return collector.Config{}, err
+		}
+		kept = append(kept, key)
+	}
+	var fieldLabelName string
+	if *fieldAsLabel {
+		if !model.LabelName(*fieldLabel).IsValid() {
+			return collector.Config{}, fmt.Errorf("invalid field label name %q", *fieldLabel)
+		}
+		fieldLabelName = *fieldLabel
+	}
+	var instanceName, instanceValue string
+	if *instanceLabel != "" {
+		i := strings.Index(*instanceLabel, "=")
+		if i < 0 {
+			return collector.Config{}, fmt.Errorf("invalid instance label %q, expected name=value", *instanceLabel)
+		}
+		instanceName, instanceValue = (*instanceLabel)[:i], (*instanceLabel)[i+1:]
+		if !model.LabelName(instanceName).IsValid() {
+			return collector.Config{}, fmt.Errorf("invalid instance label name %q", instanceName)
+		}
+	}
+	return collector.Config{
+		SampleExpiry:         *sampleExpiry,
+		ExportTimestamp:      *exportTimestamp,
+		KeepTags:             *keepTags,
+		TagKeyTrimPrefix:     *tagKeyTrimPrefix,
+		TagKeyTrimSuffix:     *tagKeyTrimSuffix,
+		InstanceLabelName:    instanceName,
+		InstanceLabelValue:   instanceValue,
+		ExpiryTag:            *expiryTag,
+		LowercaseNames:       *lowercaseNames,
+		TagsPrecedence:       *labelPrecedence == "tags",
+		NameSeparator:        *nameSeparator,
+		FieldLabel:           fieldLabelName,
+		SingleFieldBareName:  *bareName,
+		IntAsCounter:         *intAsCounter,
+		DropImprecise:        *dropImprecise,
+		CoerceNumericStrings: *coerceStrings,
+		ExemplarTag:          *exemplarTag,
+		KeepFields:           kept,
+		TypeOverrides:        overrides,
+		Mapping:              mapping,
+		DetectHistograms:     *detectHistograms,
+		DetectSummaries:      *detectSummaries,
+		MaxLabels:            *maxLabels,
+		MaxLabelsMode:        *maxLabelsMode,
+		DedupMode:            *dedupMode,
+		SkipIdentical:        *skipIdentical,
+		MinRetention:         *minRetention,
+		MaxCollectSeries:     *maxCollectSeries,
+		ChannelBuffer:        *channelBuffer,
+		DropOnFull:           *dropOnFull,
+	}, nil
 }
 
 func init() {
 	prometheus.MustRegister(version.NewCollector("influxdb_exporter"))
 	prometheus.MustRegister(udpParseErrors)
+	prometheus.MustRegister(udpRateLimited)
+	prometheus.MustRegister(udpTruncated)
+	prometheus.MustRegister(udpDropped)
+	prometheus.MustRegister(httpParseErrors)
 }
 
 func main() {
 	log.AddFlags(kingpin.CommandLine)
 	kingpin.Version(version.Print("influxdb_exporter"))
 	kingpin.HelpFlag.Short('h')
-	kingpin.Parse()
+	cmd := kingpin.Parse()
+
+	cfg, err := collectorConfig()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if *oneshot {
+		if err := runOneshot(os.Stdin, os.Stdout, cfg); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to convert line protocol: %s\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if cmd == checkCmd.FullCommand() {
+		if err := check(os.Stdout, *checkFile, *checkPrecision, cfg); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to check %s: %s\n", *checkFile, err)
+			os.Exit(1)
+		}
+		return
+	}
 
 	log.Infoln("Starting influxdb_exporter", version.Info())
 	log.Infoln("Build context", version.BuildContext())
 
-	c := newInfluxDBCollector()
+	// Both gauges share the same name so only one of them can be registered.
+	if *lastPushBy == "off" {
+		prometheus.MustRegister(lastPush)
+	} else {
+		prometheus.MustRegister(lastPushVec)
+	}
+
+	cfg.PersistPath = *persistPath
+	c := collector.NewCollector(cfg)
+	stopped := make(chan struct{})
+	go func() {
+		c.Run()
+		close(stopped)
+	}()
 	prometheus.MustRegister(c)
 
-	addr, err := net.ResolveUDPAddr("udp", *bindAddress)
-	if err != nil {
-		fmt.Printf("Failed to resolve UDP address %s: %s", *bindAddress, err)
-		os.Exit(1)
+	term := make(chan os.Signal, 1)
+	signal.Notify(term, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		<-term
+		log.Infoln("Shutting down")
+		// Wait for the queued samples to be stored and saved.
+		c.Close()
+		<-stopped
+		os.Exit(0)
+	}()
+	s := &server{collector: c}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go reloadMapping(c, hup)
+
+	var (
+		listener net.Listener
+		conn     *net.UDPConn
+	)
+	if *systemdSocket {
+		listener, conn, err = systemdListeners()
+		if err != nil {
+			fmt.Printf("Failed to get the systemd sockets: %s", err)
+			os.Exit(1)
+		}
 	}
 
-	conn, err := net.ListenUDP("udp", addr)
-	if err != nil {
-		fmt.Printf("Failed to set up UDP listener at address %s: %s", addr, err)
-		os.Exit(1)
+	if conn == nil {
+		conn, err = udpListener()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
 	}
 
-	c.conn = conn
-	go c.serveUdp()
+	s.conn = conn
+	if *udpRateLimit > 0 {
+		burst := int(*udpRateLimit)
+		if burst < 1 {
+			burst = 1
+		}
+		s.udpLimiter = rate.NewLimiter(rate.Limit(*udpRateLimit), burst)
+	}
+	s.udpQueue = make(chan udpPacket, udpQueueSize)
+	go s.parseUdp()
+	go s.serveUdp()
+
+	if len(*kafkaBrokers) > 0 || *kafkaTopic != "" {
+		if len(*kafkaBrokers) == 0 || *kafkaTopic == "" {
+			fmt.Printf("Both --kafka.brokers and --kafka.topic must be set")
+			os.Exit(1)
+		}
+		prometheus.MustRegister(kafkaConsumed)
+		prometheus.MustRegister(kafkaParseErrors)
+		r := kafka.NewReader(kafka.ReaderConfig{
+			Brokers:        *kafkaBrokers,
+			Topic:          *kafkaTopic,
+			GroupID:        *kafkaGroupID,
+			CommitInterval: *kafkaCommitInterval,
+			ErrorLogger:    kafka.LoggerFunc(log.Errorf),
+		})
+		go s.consumeKafka(context.Background(), r)
+	}
 
-	http.HandleFunc("/write", c.influxDBPost)
+	http.HandleFunc("/write", s.influxDBPost)
+	http.HandleFunc("/-/ready", s.ready)
+	http.HandleFunc("/api/v1/status", s.status)
 	// Some InfluxDB clients try to create a database.
-	http.HandleFunc("/query", func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprintf(w, `{"results": []}`)
-	})
+	http.HandleFunc("/query", query)
+
+	http.Handle(*metricsPath, promhttp.InstrumentMetricHandler(
+		prometheus.DefaultRegisterer,
+		metricsHandler(c),
+	))
+
+	http.HandleFunc("/", landing)
+
+	srv := httpServer(http.DefaultServeMux)
+	if listener != nil {
+		log.Infoln("Listening on systemd socket", listener.Addr())
+		err = srv.Serve(listener)
+	} else {
+		log.Infoln("Listening on", *listenAddress)
+		err = srv.ListenAndServe()
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
 
-	http.Handle(*metricsPath, promhttp.Handler())
+// landing serves the landing page, or a 404 if it is disabled.
+func landing(w http.ResponseWriter, r *http.Request) {
+	if *disableLandingPage {
+		http.NotFound(w, r)
+		return
+	}
+	if err := landingPage.Execute(w, struct{ MetricsPath string }{*metricsPath}); err != nil {
+		log.Errorf("Failed to render the landing page: %s", err)
+	}
+}
 
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		w.Write([]byte(`<html>
-    <head><title>InfluxDB Exporter</title></head>
-    <body>
-    <h1>InfluxDB Exporter</h1>
-    <p><a href="` + *metricsPath + `">Metrics</a></p>
-    </body>
-    </html>`))
-	})
+// httpServer returns the server of the handler with the --web timeouts.
+func httpServer(h http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              *listenAddress,
+		Handler:           h,
+		ReadHeaderTimeout: *readHeaderTimeout,
+		ReadTimeout:       *readTimeout,
+		WriteTimeout:      *writeTimeout,
+	}
+}
 
-	log.Infoln("Listening on", *listenAddress)
-	http.ListenAndServe(*listenAddress, nil)
+// udpListener returns the UDP connection listening on --udp.bind-address
+// with the --udp.network network.
+func udpListener() (*net.UDPConn, error) {
+	addr, err := net.ResolveUDPAddr(*udpNetwork, *bindAddress)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve UDP address %s: %s", *bindAddress, err)
+	}
+	conn, err := net.ListenUDP(*udpNetwork, addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up UDP listener at address %s: %s", addr, err)
+	}
+	return conn, nil
+}
+
+// reloadMapping reloads the mapping config of the collector every time a
+// signal is received on hup, until hup is closed. An invalid config is logged
+// and the previous one kept.
+func reloadMapping(c *collector.Collector, hup <-chan os.Signal) {
+	for range hup {
+		if *mappingConfig == "" {
+			continue
+		}
+		m, err := collector.LoadMappingConfig(*mappingConfig)
+		if err != nil {
+			log.Errorf("Error reloading mapping config %s, keeping the previous one: %s", *mappingConfig, err)
+			continue
+		}
+		c.SetMapping(m)
+		log.Infof("Reloaded mapping config %s", *mappingConfig)
+	}
+}
+
+// activationFiles returns the files passed by systemd socket activation. Tests
+// replace it to pass their own sockets.
+var activationFiles = activation.Files
+
+// systemdListeners returns the HTTP listener and, if any, the UDP connection
+// passed by systemd socket activation.
+func systemdListeners() (net.Listener, *net.UDPConn, error) {
+	var (
+		listener net.Listener
+		conn     *net.UDPConn
+	)
+	for _, f := range activationFiles(true) {
+		if l, err := net.FileListener(f); err == nil {
+			if listener == nil {
+				listener = l
+			} else {
+				l.Close()
+			}
+		} else if pc, err := net.FilePacketConn(f); err == nil {
+			if uc, ok := pc.(*net.UDPConn); ok && conn == nil {
+				conn = uc
+			} else {
+				pc.Close()
+			}
+		}
+		f.Close()
+	}
+	if listener == nil {
+		if conn != nil {
+			conn.Close()
+		}
+		return nil, nil, errors.New("no listening stream socket passed by systemd")
+	}
+	return listener, conn, nil
 }
@@ -0,0 +1,1028 @@
+// Copyright 2016 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/units"
+	"github.com/influxdata/influxdb/models"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/log"
+	"golang.org/x/time/rate"
+	"gopkg.in/alecthomas/kingpin.v2"
+
+	"github.com/prometheus/influxdb_exporter/internal/collector"
+	"github.com/prometheus/influxdb_exporter/internal/logtest"
+)
+
+func TestMain(m *testing.M) {
+	// Parsing an empty command line sets the flags to their defaults.
+	if _, err := kingpin.CommandLine.Parse(nil); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
+// newTestServer returns a server with a running collector. The returned
+// function stops the collector and returns the stored samples.
+func newTestServer(t testing.TB) (*server, func() []*collector.Sample) {
+	cfg, err := collectorConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := collector.NewCollector(cfg)
+	stopped := make(chan struct{})
+	go func() {
+		c.Run()
+		close(stopped)
+	}()
+	return &server{collector: c}, func() []*collector.Sample {
+		c.Close()
+		<-stopped
+		return c.Samples()
+	}
+}
+
+func TestCollectorConfigChannelBuffer(t *testing.T) {
+	defer func(v int) { *channelBuffer = v }(*channelBuffer)
+
+	*channelBuffer = -1
+	if _, err := collectorConfig(); err == nil {
+		t.Fatal("expected an error for a negative channel buffer")
+	}
+	*channelBuffer = 0
+	cfg, err := collectorConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ChannelBuffer != 0 {
+		t.Fatalf("expected an unbuffered channel, got %d", cfg.ChannelBuffer)
+	}
+}
+
+func TestConcurrentWritesSmallChannelBuffer(t *testing.T) {
+	defer func(v int) { *channelBuffer = v }(*channelBuffer)
+	*channelBuffer = 2
+
+	const writers, lines = 20, 50
+	s, samples := newTestServer(t)
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var body strings.Builder
+			for j := 0; j < lines; j++ {
+				fmt.Fprintf(&body, "cpu,writer=%d,line=%d value=%d\n", i, j, j)
+			}
+			if w := post(s, "/write", body.String()); w.Code != http.StatusNoContent {
+				t.Errorf("expected 204, got %d", w.Code)
+			}
+		}(i)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("writes blocked on the channel buffer")
+	}
+	if n := len(samples()); n != writers*lines {
+		t.Fatalf("expected %d samples, got %d", writers*lines, n)
+	}
+}
+
+func TestCollectorConfigInjectedLabels(t *testing.T) {
+	defer func(v string) { *sourceIPLabel = v }(*sourceIPLabel)
+	defer func(v string) { *rpLabel = v }(*rpLabel)
+
+	for _, flag := range []*string{sourceIPLabel, rpLabel} {
+		*flag = "source-ip"
+		if _, err := collectorConfig(); err == nil {
+			t.Fatal("expected an error for an invalid label name")
+		}
+		*flag = "source_ip"
+		if _, err := collectorConfig(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCollectorConfigSampleExpiry(t *testing.T) {
+	defer func(v time.Duration) { *sampleExpiry = v }(*sampleExpiry)
+
+	*sampleExpiry = -time.Second
+	if _, err := collectorConfig(); err == nil {
+		t.Fatal("expected an error for a negative sample expiry")
+	}
+	*sampleExpiry = 0
+	if _, err := collectorConfig(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCollectorConfigInstanceLabel(t *testing.T) {
+	defer func(v string) { *instanceLabel = v }(*instanceLabel)
+
+	for _, invalid := range []string{"exporter", "1exporter=a", "=a"} {
+		*instanceLabel = invalid
+		if _, err := collectorConfig(); err == nil {
+			t.Fatalf("expected an error for the instance label %q", invalid)
+		}
+	}
+	*instanceLabel = "exporter=edge=1"
+	cfg, err := collectorConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.InstanceLabelName != "exporter" || cfg.InstanceLabelValue != "edge=1" {
+		t.Fatalf("expected exporter=edge=1, got %s=%s", cfg.InstanceLabelName, cfg.InstanceLabelValue)
+	}
+}
+
+func TestOneshot(t *testing.T) {
+	cfg, err := collectorConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The second point is older than the sample expiry.
+	in := fmt.Sprintf("cpu,host=a idle=97.5\nmem,host=a free=3 %d\n", time.Now().Add(-time.Hour).UnixNano())
+	var out bytes.Buffer
+	if err := runOneshot(strings.NewReader(in), &out, cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `# HELP cpu_idle InfluxDB Metric
+# TYPE cpu_idle untyped
+cpu_idle{host="a"} 97.5
+# HELP mem_free InfluxDB Metric
+# TYPE mem_free untyped
+mem_free{host="a"} 3
+`
+	if out.String() != expected {
+		t.Fatalf("expected:\n%s\ngot:\n%s", expected, out.String())
+	}
+}
+
+func TestQueryStatementIDs(t *testing.T) {
+	r := httptest.NewRequest("GET", "/query?q="+url.QueryEscape("CREATE DATABASE foo; SELECT * FROM cpu; show databases;"), nil)
+	w := httptest.NewRecorder()
+	query(w, r)
+
+	expected := `{"results":[{"statement_id":0},{"statement_id":1},{"statement_id":2,"series":[{"name":"databases","columns":["name"],"values":[["prometheus"]]}]}]}`
+	if got := strings.TrimSpace(w.Body.String()); got != expected {
+		t.Fatalf("expected %s, got %s", expected, got)
+	}
+}
+
+// streamedPoints parses the body line by line like influxDBPost.
+func streamedPoints(t testing.TB, body []byte) []string {
+	var points []string
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	scanner.Split(scanLines)
+	for scanner.Scan() {
+		parsed, err := models.ParsePoints(scanner.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, p := range parsed {
+			points = append(points, p.String())
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return points
+}
+
+func TestScanLines(t *testing.T) {
+	for _, body := range []string{
+		"cpu value=1 1\nmem value=2 2\n",
+		"cpu value=1 1\n\n# comment\nmem value=2 2",
+		"log,host=a msg=\"first\nsecond\",value=1 1\nmem value=2 2\n",
+		"log msg=\"escaped \\\" quote\nand newline\" 1\n",
+		"log,tag=with\\ space msg=\"a,b=c\nd\" 1\n",
+		"log\\ name,tag=\"quoted\" value=1 1\nmem value=2 2\n",
+	} {
+		buffered, err := models.ParsePoints([]byte(body))
+		if err != nil {
+			t.Fatalf("%q: %s", body, err)
+		}
+		var expected []string
+		for _, p := range buffered {
+			expected = append(expected, p.String())
+		}
+		if got := streamedPoints(t, []byte(body)); fmt.Sprint(got) != fmt.Sprint(expected) {
+			t.Fatalf("%q: expected %q, got %q", body, expected, got)
+		}
+	}
+}
+
+// BenchmarkParseBody compares parsing the body line by line like influxDBPost
+// with reading it whole first like it used to.
+func BenchmarkParseBody(b *testing.B) {
+	var body bytes.Buffer
+	for i := 0; i < 1000; i++ {
+		fmt.Fprintf(&body, "log,host=web%d,region=eu msg=\"line %d\nsecond line\",value=%di %d\n", i, i, i, i)
+	}
+	now := time.Now()
+	b.Run("streamed", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(body.Len()))
+		for i := 0; i < b.N; i++ {
+			scanner := bufio.NewScanner(bytes.NewReader(body.Bytes()))
+			scanner.Split(scanLines)
+			for scanner.Scan() {
+				if _, err := models.ParsePointsWithPrecision(scanner.Bytes(), now, "ns"); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+	b.Run("buffered", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(body.Len()))
+		for i := 0; i < b.N; i++ {
+			buf, err := ioutil.ReadAll(bytes.NewReader(body.Bytes()))
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, err := models.ParsePointsWithPrecision(buf, now, "ns"); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestWriteGzip(t *testing.T) {
+	var body bytes.Buffer
+	gz := gzip.NewWriter(&body)
+	if _, err := gz.Write([]byte("cpu,host=a value=1\nmem,host=a free=2\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, samples := newTestServer(t)
+	if w := post(s, "/write", body.String(), "Content-Encoding", "gzip"); w.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := post(s, "/write", "cpu value=1", "Content-Encoding", "gzip"); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a body that isn't gzipped, got %d", w.Code)
+	}
+	if got := samples(); len(got) != 2 {
+		t.Fatalf("expected 2 samples, got %d", len(got))
+	}
+}
+
+func TestWriteMaxLineSize(t *testing.T) {
+	defer func(v units.Base2Bytes) { *maxLineSize = v }(*maxLineSize)
+	*maxLineSize = 32
+
+	s, _ := newTestServer(t)
+	if w := post(s, "/write", "cpu value=1\n"); w.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", w.Code)
+	}
+	w := post(s, "/write", "cpu value=1\ncpu,host=a-very-long-host-name value=1\n")
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected 413 for a line longer than 32B, got %d", w.Code)
+	}
+
+	for _, invalid := range []units.Base2Bytes{0, -1} {
+		*maxLineSize = invalid
+		if _, err := collectorConfig(); err == nil {
+			t.Fatalf("expected an error for a max line size of %d", invalid)
+		}
+	}
+}
+
+// newUDPServer returns a server with a UDP connection receiving the packets
+// written to the returned client, for the test to call serveUdp. The queue is
+// left for the test to read. The returned function stops the collector and
+// returns the stored samples.
+func newUDPServer(t *testing.T) (*server, *net.UDPConn, func() []*collector.Sample) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := net.DialUDP("udp", nil, conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, samples := newTestServer(t)
+	s.conn = conn
+	s.udpQueue = make(chan udpPacket, udpQueueSize)
+	return s, client, samples
+}
+
+// nextPacket returns the next queued packet.
+func nextPacket(t *testing.T, s *server) udpPacket {
+	t.Helper()
+	select {
+	case p := <-s.udpQueue:
+		return p
+	case <-time.After(time.Second):
+		t.Fatal("no UDP packet queued")
+	}
+	return udpPacket{}
+}
+
+func TestUDPMaxPayload(t *testing.T) {
+	defer func(v units.Base2Bytes) { *udpMaxPayload = v }(*udpMaxPayload)
+	*udpMaxPayload = 16
+
+	s, client, _ := newUDPServer(t)
+	go s.serveUdp()
+	dropped := testutil.ToFloat64(udpTruncated)
+	for _, p := range []string{"cpu value=123456789", "cpu value=1", "cpu value=123456"} {
+		if _, err := client.Write([]byte(p)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if p := nextPacket(t, s); string(p.data) != "cpu value=1" {
+		t.Fatalf("expected the packet within the limit, got %q", p.data)
+	}
+	if p := nextPacket(t, s); string(p.data) != "cpu value=123456" {
+		t.Fatalf("expected the packet of the maximum size, got %q", p.data)
+	}
+	if v := testutil.ToFloat64(udpTruncated) - dropped; v != 1 {
+		t.Fatalf("expected 1 dropped packet, got %v", v)
+	}
+
+	for _, invalid := range []units.Base2Bytes{0, -1} {
+		*udpMaxPayload = invalid
+		if _, err := collectorConfig(); err == nil {
+			t.Fatalf("expected an error for a max payload size of %d", invalid)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	cfg, err := collectorConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := check(&out, "testdata/check.lp", "s", cfg); err != nil {
+		t.Fatal(err)
+	}
+	expected := `cpu_idle{host="a"} 97.5
+cpu_idle{host="b"} 90
+cpu_user{host="a"} 2
+mem_free{host="a"} 3
+`
+	if out.String() != expected {
+		t.Fatalf("expected:\n%s\ngot:\n%s", expected, out.String())
+	}
+
+	// The timestamps would be out of range as nanoseconds.
+	if err := check(&out, "testdata/check.lp", "h", cfg); err == nil {
+		t.Fatal("expected an error for out of range timestamps")
+	}
+}
+
+func TestCheckPrecisionFlag(t *testing.T) {
+	defer func() {
+		if _, err := kingpin.CommandLine.Parse(nil); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	if _, err := kingpin.CommandLine.Parse([]string{"check", "--precision=s", "testdata/check.lp"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kingpin.CommandLine.Parse([]string{"check", "--precision=seconds", "testdata/check.lp"}); err == nil {
+		t.Fatal("expected an error for an unknown precision")
+	}
+}
+
+func TestSlowWriteThreshold(t *testing.T) {
+	defer func(v time.Duration) { *slowWriteThreshold = v }(*slowWriteThreshold)
+	if err := log.Base().SetLevel("debug"); err != nil {
+		t.Fatal(err)
+	}
+	defer log.Base().SetLevel("info")
+	hook := logtest.NewHook()
+
+	s, _ := newTestServer(t)
+	for _, threshold := range []time.Duration{time.Hour, time.Nanosecond} {
+		*slowWriteThreshold = threshold
+		if w := post(s, "/write", "cpu value=1\nmem value=2\n"); w.Code != http.StatusNoContent {
+			t.Fatalf("expected 204, got %d", w.Code)
+		}
+	}
+
+	if slow := hook.Logged("Slow write"); len(slow) != 1 || !strings.Contains(slow[0], "24 bytes, 2 points") {
+		t.Fatalf("expected a single slow write logged, got %q", slow)
+	}
+}
+
+// socketFiles returns a copy of the files of the sockets as passed by systemd.
+func socketFiles(t *testing.T, sockets ...interface{ File() (*os.File, error) }) func(bool) []*os.File {
+	var files []*os.File
+	for _, s := range sockets {
+		f, err := s.File()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, f)
+	}
+	return func(bool) []*os.File { return files }
+}
+
+func TestSystemdListeners(t *testing.T) {
+	defer func(f func(bool) []*os.File) { activationFiles = f }(activationFiles)
+
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	u, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u.Close()
+
+	activationFiles = socketFiles(t, u, l)
+	listener, conn, err := systemdListeners()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if listener.Addr().String() != l.Addr().String() {
+		t.Fatalf("expected listener on %s, got %s", l.Addr(), listener.Addr())
+	}
+	if conn == nil || conn.LocalAddr().String() != u.LocalAddr().String() {
+		t.Fatalf("expected UDP connection on %s, got %v", u.LocalAddr(), conn)
+	}
+	listener.Close()
+	conn.Close()
+
+	// Without a datagram socket, the UDP listener is set up as usual.
+	activationFiles = socketFiles(t, l)
+	listener, conn, err = systemdListeners()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn != nil {
+		t.Fatalf("expected no UDP connection, got %s", conn.LocalAddr())
+	}
+	listener.Close()
+
+	activationFiles = socketFiles(t, u)
+	if _, _, err := systemdListeners(); err == nil {
+		t.Fatal("expected an error without a stream socket")
+	}
+}
+
+func TestReloadMapping(t *testing.T) {
+	defer func(v string) { *mappingConfig = v }(*mappingConfig)
+	f, err := ioutil.TempFile("", "mapping")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.Close()
+	*mappingConfig = f.Name()
+
+	s, samples := newTestServer(t)
+	for _, tc := range []struct {
+		config string
+		line   string
+	}{
+		{config: "mappings:\n- match: cpu\n  name: node_cpu\n", line: "cpu value=1"},
+		// An invalid config keeps the previous rules.
+		{config: "mappings:\n- match: [\n", line: "cpu,host=b value=2"},
+	} {
+		if err := ioutil.WriteFile(f.Name(), []byte(tc.config), 0644); err != nil {
+			t.Fatal(err)
+		}
+		hup := make(chan os.Signal, 1)
+		hup <- syscall.SIGHUP
+		close(hup)
+		reloadMapping(s.collector, hup)
+
+		points, err := models.ParsePoints([]byte(tc.line))
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.collector.ParsePoints(points)
+	}
+
+	got := samples()
+	if len(got) != 2 {
+		t.Fatalf("expected 2 samples, got %d", len(got))
+	}
+	for _, s := range got {
+		if s.Name != "node_cpu" {
+			t.Fatalf("expected the sample to be renamed by the mapping, got %s", s.Name)
+		}
+	}
+}
+
+// parsePackets parses the packets like parseUdp.
+func parsePackets(s *server, packets ...udpPacket) {
+	q := make(chan udpPacket, len(packets))
+	for _, p := range packets {
+		q <- p
+	}
+	close(q)
+	(&server{collector: s.collector, udpQueue: q}).parseUdp()
+}
+
+func TestUDPSourceIPLabel(t *testing.T) {
+	defer func(v string) { *sourceIPLabel = v }(*sourceIPLabel)
+	*sourceIPLabel = "source_ip"
+
+	s, client, stored := newUDPServer(t)
+	go s.serveUdp()
+	if _, err := client.Write([]byte("cpu,host=a value=1")); err != nil {
+		t.Fatal(err)
+	}
+	parsePackets(s, nextPacket(t, s))
+
+	samples := stored()
+	if len(samples) != 1 {
+		t.Fatalf("expected 1 sample, got %d", len(samples))
+	}
+	if ip := samples[0].Labels["source_ip"]; ip != "127.0.0.1" {
+		t.Fatalf("expected source_ip 127.0.0.1, got %q", ip)
+	}
+}
+
+func TestUDPPrecision(t *testing.T) {
+	defer func(v string) { *udpPrecision = v }(*udpPrecision)
+	*udpPrecision = "s"
+
+	s, client, stored := newUDPServer(t)
+	go s.serveUdp()
+	ts := time.Now().Add(-time.Minute).Truncate(time.Second)
+	if _, err := client.Write([]byte(fmt.Sprintf("cpu,host=a value=1 %d", ts.Unix()))); err != nil {
+		t.Fatal(err)
+	}
+	parsePackets(s, nextPacket(t, s))
+
+	samples := stored()
+	if len(samples) != 1 {
+		t.Fatalf("expected 1 sample, got %d", len(samples))
+	}
+	if !samples[0].Timestamp.Equal(ts) {
+		t.Fatalf("expected the sample at %s, got %s", ts, samples[0].Timestamp)
+	}
+	// Read as nanoseconds, the timestamp would be expired.
+	if n := testutil.CollectAndCount(s.collector.Measurement("cpu")); n != 1 {
+		t.Fatalf("expected the sample to be exported, got %d metrics", n)
+	}
+}
+
+// post sends the body to the write handler with the headers given as name and
+// value pairs.
+func post(s *server, target, body string, headers ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", target, strings.NewReader(body))
+	for i := 0; i+1 < len(headers); i += 2 {
+		r.Header.Set(headers[i], headers[i+1])
+	}
+	w := httptest.NewRecorder()
+	s.influxDBPost(w, r)
+	return w
+}
+
+func TestWriteNoContent(t *testing.T) {
+	s, _ := newTestServer(t)
+	w := post(s, "/write", "cpu value=1")
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "" {
+		t.Fatalf("expected no Content-Type, got %q", ct)
+	}
+	if w.Body.Len() != 0 {
+		t.Fatalf("expected an empty body, got %q", w.Body.String())
+	}
+}
+
+func TestMetricsOpenMetrics(t *testing.T) {
+	s, _ := newTestServer(t)
+	post(s, "/write", "cpu value=1")
+	h := metricsHandler(s.collector)
+
+	for _, target := range []string{"/metrics", "/metrics?measurement=cpu"} {
+		for _, tc := range []struct {
+			accept string
+			eof    bool
+		}{
+			{accept: "application/openmetrics-text; version=0.0.1", eof: true},
+			{accept: "text/plain"},
+		} {
+			r := httptest.NewRequest("GET", target, nil)
+			r.Header.Set("Accept", tc.accept)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if eof := strings.HasSuffix(w.Body.String(), "# EOF\n"); eof != tc.eof {
+				t.Fatalf("%s with Accept %q: expected # EOF %t, got:\n%s", target, tc.accept, tc.eof, w.Body.String())
+			}
+		}
+	}
+}
+
+func TestMetricsExemplars(t *testing.T) {
+	defer func(v string) { *exemplarTag = v }(*exemplarTag)
+	defer func(v bool) { *intAsCounter = v }(*intAsCounter)
+	*exemplarTag = "trace_id"
+	*intAsCounter = true
+
+	s, stop := newTestServer(t)
+	post(s, "/write", "http,trace_id=abc123 requests_total=5i\nrpc,trace_id=def456 calls=3i")
+	stop()
+
+	r := httptest.NewRequest("GET", "/metrics?measurement=http", nil)
+	r.Header.Set("Accept", "application/openmetrics-text; version=0.0.1")
+	w := httptest.NewRecorder()
+	metricsHandler(s.collector).ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/openmetrics-text") {
+		t.Fatalf("expected the OpenMetrics format, got %q", ct)
+	}
+	if !strings.Contains(w.Body.String(), "# TYPE http_requests counter\nhttp_requests_total 5.0 # {trace_id=\"abc123\"} 5.0 ") {
+		t.Fatalf("expected the counter with its exemplar, got:\n%s", w.Body.String())
+	}
+
+	// Counters not named <name>_total have no exemplar.
+	r = httptest.NewRequest("GET", "/metrics?measurement=rpc", nil)
+	r.Header.Set("Accept", "application/openmetrics-text; version=0.0.1")
+	w = httptest.NewRecorder()
+	metricsHandler(s.collector).ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if strings.Contains(w.Body.String(), "trace_id") {
+		t.Fatalf("expected no exemplar on rpc_calls, got:\n%s", w.Body.String())
+	}
+}
+
+func TestWriteContentType(t *testing.T) {
+	s, _ := newTestServer(t)
+	for _, tc := range []struct {
+		contentType string
+		code        int
+	}{
+		{contentType: "", code: http.StatusNoContent},
+		{contentType: "text/plain; charset=utf-8", code: http.StatusNoContent},
+		{contentType: "application/octet-stream", code: http.StatusNoContent},
+		{contentType: "application/x-www-form-urlencoded", code: http.StatusNoContent},
+		{contentType: "application/json", code: http.StatusUnsupportedMediaType},
+		{contentType: "application/x-protobuf", code: http.StatusUnsupportedMediaType},
+		{contentType: "not a media type;", code: http.StatusUnsupportedMediaType},
+	} {
+		var headers []string
+		if tc.contentType != "" {
+			headers = []string{"Content-Type", tc.contentType}
+		}
+		if w := post(s, "/write", "cpu value=1", headers...); w.Code != tc.code {
+			t.Fatalf("Content-Type %q: expected %d, got %d: %s", tc.contentType, tc.code, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestWriteDefaultPrecision(t *testing.T) {
+	defer func(v string) { *defaultPrecision = v }(*defaultPrecision)
+	*defaultPrecision = "s"
+
+	s, samples := newTestServer(t)
+	post(s, "/write", "cpu value=1 1600000000")
+	post(s, "/write?precision=ms", "mem value=1 1600000000000")
+
+	expected := time.Unix(1600000000, 0)
+	got := samples()
+	if len(got) != 2 {
+		t.Fatalf("expected 2 samples, got %d", len(got))
+	}
+	for _, s := range got {
+		if !s.Timestamp.Equal(expected) {
+			t.Fatalf("expected %s at %s, got %s", s.Name, expected, s.Timestamp)
+		}
+	}
+}
+
+func TestWriteRetentionPolicyLabel(t *testing.T) {
+	defer func(v string) { *rpLabel = v }(*rpLabel)
+	*rpLabel = "rp"
+
+	s, samples := newTestServer(t)
+	post(s, "/write?db=telegraf&rp=weekly", "cpu value=1")
+	post(s, "/write?db=telegraf&rp=", "mem value=1")
+
+	got := samples()
+	if len(got) != 2 {
+		t.Fatalf("expected 2 samples, got %d", len(got))
+	}
+	if rp := got[0].Labels["rp"]; got[0].Name != "cpu" || rp != "weekly" {
+		t.Fatalf("expected cpu with rp=weekly, got %s with %v", got[0].Name, got[0].Labels)
+	}
+	if _, ok := got[1].Labels["rp"]; ok {
+		t.Fatalf("expected no rp label for an empty retention policy, got %v", got[1].Labels)
+	}
+}
+
+// waitCounter waits for the counter to reach the value.
+func waitCounter(t *testing.T, c prometheus.Counter, v float64) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for testutil.ToFloat64(c) < v {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the counter to reach %v, got %v", v, testutil.ToFloat64(c))
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestUDPRateLimit(t *testing.T) {
+	s, client, samples := newUDPServer(t)
+	// A burst of 2 packets then less than one per hour.
+	s.udpLimiter = rate.NewLimiter(rate.Every(time.Hour), 2)
+	go s.serveUdp()
+
+	limited := testutil.ToFloat64(udpRateLimited)
+	for i := 0; i < 5; i++ {
+		if _, err := client.Write([]byte(fmt.Sprintf("cpu,n=%d value=1", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	parsePackets(s, nextPacket(t, s), nextPacket(t, s))
+	waitCounter(t, udpRateLimited, limited+3)
+
+	if got := samples(); len(got) != 2 {
+		t.Fatalf("expected the 2 packets under the limit to be parsed, got %d samples", len(got))
+	}
+}
+
+func TestUDPOverflowDrop(t *testing.T) {
+	defer func(v string) { *udpOverflow = v }(*udpOverflow)
+	*udpOverflow = "drop"
+
+	s, client, samples := newUDPServer(t)
+	// Nothing parses the queue, which is full after the first packet.
+	s.udpQueue = make(chan udpPacket, 1)
+	go s.serveUdp()
+
+	dropped := testutil.ToFloat64(udpDropped)
+	for i := 0; i < 3; i++ {
+		if _, err := client.Write([]byte(fmt.Sprintf("cpu,n=%d value=1", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitCounter(t, udpDropped, dropped+2)
+
+	parsePackets(s, nextPacket(t, s))
+	got := samples()
+	if len(got) != 1 || got[0].Labels["n"] != "0" {
+		t.Fatalf("expected only the first packet to be parsed, got %v", got)
+	}
+}
+
+func TestUDPIdleWarn(t *testing.T) {
+	defer func(v time.Duration) { *udpIdleWarn = v }(*udpIdleWarn)
+	*udpIdleWarn = 20 * time.Millisecond
+	hook := logtest.NewHook()
+
+	s, _, _ := newUDPServer(t)
+	go s.serveUdp()
+
+	deadline := time.Now().Add(time.Second)
+	for len(hook.Logged("No UDP packet received for 20ms")) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected a warning without UDP packets")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestLastPushByMeasurement(t *testing.T) {
+	defer func(v string) { *lastPushBy = v }(*lastPushBy)
+	*lastPushBy = "measurement"
+
+	s, _ := newTestServer(t)
+	post(s, "/write", "cpu value=1\nmem value=1")
+	cpu := testutil.ToFloat64(lastPushVec.WithLabelValues("cpu"))
+	mem := testutil.ToFloat64(lastPushVec.WithLabelValues("mem"))
+	if cpu == 0 || mem == 0 {
+		t.Fatalf("expected both measurements to be pushed, got cpu=%v mem=%v", cpu, mem)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	post(s, "/write", "mem value=2")
+	if v := testutil.ToFloat64(lastPushVec.WithLabelValues("cpu")); v != cpu {
+		t.Fatalf("expected the cpu last push to stay at %v, got %v", cpu, v)
+	}
+	if v := testutil.ToFloat64(lastPushVec.WithLabelValues("mem")); v <= mem {
+		t.Fatalf("expected the mem last push to advance from %v, got %v", mem, v)
+	}
+}
+
+func TestWriteErrorJSON(t *testing.T) {
+	s, _ := newTestServer(t)
+	w := post(s, "/write", "cpu value=1\ninvalid\n")
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Fatalf("expected a JSON response, got %q", ct)
+	}
+	var body struct {
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("invalid JSON %q: %s", w.Body.String(), err)
+	}
+	if !strings.Contains(body.Error, "unable to parse 'invalid'") {
+		t.Fatalf("expected the parse error under the error key, got %q", body.Error)
+	}
+	if h := w.Header().Get("X-Influxdb-Error"); h != body.Error {
+		t.Fatalf("expected the X-Influxdb-Error header to hold the error, got %q", h)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	s, samples := newTestServer(t)
+	post(s, "/write", "cpu,host=a idle=97.5,user=2.5\nmem,host=a free=3")
+	// Wait for the collector to store the samples.
+	samples()
+
+	w := httptest.NewRecorder()
+	s.status(w, httptest.NewRequest("GET", "/api/v1/status", nil))
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Fatalf("expected a JSON response, got %q", ct)
+	}
+	var body map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("invalid JSON %q: %s", w.Body.String(), err)
+	}
+	for _, k := range []string{
+		"series",
+		"oldest_sample_age_seconds",
+		"newest_sample_age_seconds",
+		"http_parse_errors",
+		"udp_parse_errors",
+		"udp_dropped",
+		"udp_rate_limited",
+		"heap_alloc_bytes",
+		"heap_inuse_bytes",
+		"heap_objects",
+	} {
+		if _, ok := body[k]; !ok {
+			t.Fatalf("expected the %s key in %s", k, w.Body.String())
+		}
+	}
+	if n := body["series"]; n != 3.0 {
+		t.Fatalf("expected 3 series, got %v", n)
+	}
+}
+
+func TestReadyAfterFirstPush(t *testing.T) {
+	defer func(v bool) { *readyAfterFirstPush = v }(*readyAfterFirstPush)
+	*readyAfterFirstPush = true
+
+	s, _ := newTestServer(t)
+	ready := func() int {
+		w := httptest.NewRecorder()
+		s.ready(w, httptest.NewRequest("GET", "/-/ready", nil))
+		return w.Code
+	}
+	if code := ready(); code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 before the first push, got %d", code)
+	}
+	post(s, "/write", "cpu value=1")
+	if code := ready(); code != http.StatusOK {
+		t.Fatalf("expected 200 after the first push, got %d", code)
+	}
+}
+
+func TestUDP4(t *testing.T) {
+	defer func(v string) { *udpNetwork = v }(*udpNetwork)
+	defer func(v string) { *bindAddress = v }(*bindAddress)
+	*udpNetwork = "udp4"
+	*bindAddress = "localhost:0"
+
+	conn, err := udpListener()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip := conn.LocalAddr().(*net.UDPAddr).IP; ip.To4() == nil {
+		t.Fatalf("expected an IPv4 listener, got %s", ip)
+	}
+	client, err := net.DialUDP("udp4", nil, conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, samples := newTestServer(t)
+	s.conn = conn
+	s.udpQueue = make(chan udpPacket, udpQueueSize)
+	go s.serveUdp()
+	if _, err := client.Write([]byte("cpu value=1")); err != nil {
+		t.Fatal(err)
+	}
+	parsePackets(s, nextPacket(t, s))
+	if got := samples(); len(got) != 1 || got[0].Name != "cpu" {
+		t.Fatalf("expected the cpu sample, got %v", got)
+	}
+
+	// An IPv4 address can't be used with the udp6 network.
+	*udpNetwork = "udp6"
+	*bindAddress = "127.0.0.1:0"
+	if conn, err := udpListener(); err == nil {
+		conn.Close()
+		t.Fatal("expected an error listening on an IPv4 address with udp6")
+	}
+}
+
+func TestReadTimeout(t *testing.T) {
+	defer func(v time.Duration) { *readTimeout = v }(*readTimeout)
+	*readTimeout = 100 * time.Millisecond
+
+	s, _ := newTestServer(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httpServer(http.HandlerFunc(s.influxDBPost))
+	go srv.Serve(l)
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// Send half of the body and stall.
+	if _, err := fmt.Fprint(conn, "POST /write HTTP/1.1\r\nHost: localhost\r\nContent-Length: 22\r\n\r\ncpu value=1\n"); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("expected 500 for a body not sent in time, got %d", resp.StatusCode)
+	}
+}
+
+func TestLandingPage(t *testing.T) {
+	defer func(disabled bool, path string) {
+		*disableLandingPage, *metricsPath = disabled, path
+	}(*disableLandingPage, *metricsPath)
+	*metricsPath = "/custom-metrics"
+
+	for _, tc := range []struct {
+		disabled bool
+		code     int
+	}{
+		{code: http.StatusOK},
+		{disabled: true, code: http.StatusNotFound},
+	} {
+		*disableLandingPage = tc.disabled
+		w := httptest.NewRecorder()
+		landing(w, httptest.NewRequest("GET", "/", nil))
+		if w.Code != tc.code {
+			t.Fatalf("disabled %t: expected %d, got %d", tc.disabled, tc.code, w.Code)
+		}
+		if link := strings.Contains(w.Body.String(), `<a href="/custom-metrics">`); link == tc.disabled {
+			t.Fatalf("disabled %t: unexpected body %q", tc.disabled, w.Body.String())
+		}
+	}
+}